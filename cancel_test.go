@@ -0,0 +1,51 @@
+package message
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// Test a canceled request cancels the handler's context and its reply is dropped
+func TestSendContextCancel(t *testing.T) {
+	r := NewReceiver("127.0.0.1:0")
+	if err := r.GoStart(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	canceled := make(chan bool, 1)
+	go func() {
+		msg := r.Recv()
+		select {
+		case <-msg.Context().Done():
+			canceled <- true
+		case <-time.After(time.Second):
+			canceled <- false
+		}
+		// nobody reads this reply
+		msg.reply <- NewMessage(0, []byte("too late"))
+		echo(r)
+	}()
+
+	sender, err := NewSender(r.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := sender.SendContext(ctx, NewMessage(MsgRequireReply+1, nil)); err != context.DeadlineExceeded {
+		t.Fatal("expect context.DeadlineExceeded, got ", err)
+	}
+	if !<-canceled {
+		t.Fatal("handler's context is not canceled")
+	}
+
+	reply, err := sender.SendContext(context.Background(), NewMessage(MsgRequireReply+1, []byte("hello")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply.Bytes()) != "hello" {
+		t.Fatal("received the reply of a canceled request")
+	}
+}
@@ -0,0 +1,209 @@
+package message
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	"github.com/coreos/go-log/log"
+)
+
+const (
+	// ChunkSize bounds the frames a payload sent by SendReader is split into,
+	// other messages on the connection are interleaved between them.
+	ChunkSize = 64 * 1024
+
+	chunkBufSize = 16 // chunks buffered per incoming message
+)
+
+// chunkReader reassembles the payload of a chunked message
+type chunkReader struct {
+	ch       chan []byte
+	buf      []byte
+	done     <-chan struct{} // of the request, or of the session for one-way messages
+	complete bool
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	for len(cr.buf) == 0 {
+		b, ok := <-cr.ch
+		if !ok {
+			if cr.complete {
+				return 0, io.EOF
+			}
+			return 0, io.ErrUnexpectedEOF
+		}
+		cr.buf = b
+	}
+	n := copy(p, cr.buf)
+	cr.buf = cr.buf[n:]
+	return n, nil
+}
+
+// Reader returns the payload of the message. The payload of a message
+// sent by SendReader is delivered while it is still being received, the
+// handler must read it to the end or the connection stalls.
+func (m *Message) Reader() io.Reader {
+	if m.body != nil {
+		return m.body
+	}
+	return bytes.NewReader(m.bytes)
+}
+
+// dispatchChunk handles the frames of chunked messages
+func (s *session) dispatchChunk(kind uint8, id uint32, msg *Message) {
+	if kind == frameChunkStart {
+		cr := &chunkReader{ch: make(chan []byte, chunkBufSize)}
+		msg.body = cr
+		s.mu.Lock()
+		s.chunks[id] = cr
+		s.mu.Unlock()
+
+		if msg.RequireReply() {
+			s.attachContext(id, msg)
+			cr.done = msg.ctx.Done()
+			msg.AttachReplyChan()
+			s.track.begin()
+			s.deliver(msg)
+			go s.reply(id, msg)
+		} else {
+			cr.done = s.done
+			s.deliver(msg)
+		}
+		return
+	}
+
+	s.mu.Lock()
+	cr := s.chunks[id]
+	if kind != frameChunk {
+		delete(s.chunks, id)
+	}
+	s.mu.Unlock()
+	if cr == nil {
+		return
+	}
+
+	switch kind {
+	case frameChunk:
+		select {
+		case cr.ch <- msg.bytes:
+		case <-cr.done:
+			// canceled, drop the rest of the payload
+		}
+	case frameChunkEnd:
+		cr.complete = true
+		close(cr.ch)
+	case frameChunkAbort:
+		close(cr.ch)
+	}
+}
+
+// closeChunks fails the payloads still being received when the session
+// breaks. Only the goroutine running the session sends on the chunk
+// readers, so only it may close them.
+func (s *session) closeChunks() {
+	s.mu.Lock()
+	chunks := s.chunks
+	s.chunks = nil
+	s.mu.Unlock()
+
+	for _, cr := range chunks {
+		close(cr.ch)
+	}
+}
+
+// sendReader sends a message whose bytes are read from r, split into
+// frames of at most ChunkSize bytes, and waits for its reply if it
+// requires one.
+func (s *session) sendReader(msgType uint16, r io.Reader) (*Message, error) {
+	msg := NewMessage(msgType, nil)
+	ch := make(chan *Message, 1)
+	if err := s.acquire(context.Background()); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	if err := s.err; err != nil {
+		s.mu.Unlock()
+		return nil, err
+	}
+	s.nextID++
+	id := s.nextID
+	if msg.RequireReply() {
+		s.pending[id] = ch
+	}
+	s.mu.Unlock()
+
+	if err := s.writeFrame(frameChunkStart, id, msg); err != nil {
+		s.close(err)
+		return nil, err
+	}
+
+	// frames are written one at a time, so that other messages
+	// on the connection do not wait for the whole payload
+	buf := make([]byte, ChunkSize)
+	chunk := NewEmptyMessage()
+	for {
+		n, rerr := io.ReadFull(r, buf)
+		if n > 0 {
+			chunk.bytes = buf[:n]
+			if err := s.writeFrameAt(msg.Priority(), frameChunk, id, chunk); err != nil {
+				s.close(err)
+				return nil, err
+			}
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			log.Warning("session.sendReader() error: ", rerr)
+			s.mu.Lock()
+			delete(s.pending, id)
+			s.mu.Unlock()
+			if err := s.writeFrameAt(msg.Priority(), frameChunkAbort, id, NewEmptyMessage()); err != nil {
+				s.close(err)
+			}
+			return nil, rerr
+		}
+	}
+	if err := s.writeFrameAt(msg.Priority(), frameChunkEnd, id, NewEmptyMessage()); err != nil {
+		s.close(err)
+		return nil, err
+	}
+
+	if !msg.RequireReply() {
+		return nil, nil
+	}
+	select {
+	case reply := <-ch:
+		return replyOrErr(reply)
+	case <-s.done:
+		return nil, s.err
+	}
+}
+
+// SendReader sends a message of msgType whose payload is read from r,
+// e.g. a snapshot too large to hold in memory. The payload is split into
+// chunks interleaved with other messages, and the handler reads it from
+// Message.Reader. The connection is switched to the session format if needed.
+func (s *Sender) SendReader(msgType uint16, r io.Reader) (*Message, error) {
+	sess, err := s.session()
+	if err != nil {
+		return nil, err
+	}
+	return sess.sendReader(msgType, r)
+}
+
+// SendReader sends a message whose payload is read from r in chunks
+func (c *PeerConn) SendReader(msgType uint16, r io.Reader) (*Message, error) {
+	return c.sendReader(msgType, r)
+}
+
+// SendReader sends a message to replica id whose payload is read from r in chunks
+func (m *Mesh) SendReader(id NodeID, msgType uint16, r io.Reader) (*Message, error) {
+	c, err := m.conn(id)
+	if err != nil {
+		return nil, err
+	}
+	return c.SendReader(msgType, r)
+}
@@ -0,0 +1,113 @@
+package message
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestSendReader(t *testing.T) {
+	r := NewReceiver("127.0.0.1:0")
+	if err := r.GoStart(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	payload := make([]byte, 10*ChunkSize+123)
+	rand.Read(payload)
+
+	go func() {
+		msg := r.Recv()
+		b, err := ioutil.ReadAll(msg.Reader())
+		if err != nil {
+			t.Error(err)
+		}
+		if !bytes.Equal(b, payload) {
+			t.Error("payloads are not equal")
+		}
+		msg.reply <- NewMessage(0, []byte("received"))
+	}()
+
+	sender, err := NewSender(r.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := sender.SendReader(MsgRequireReply+1, bytes.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply.Bytes()) != "received" {
+		t.Fatal("error recv!")
+	}
+}
+
+// slowReader returns one chunk at a time with a pause in between
+type slowReader struct {
+	chunks int
+}
+
+func (sr *slowReader) Read(p []byte) (int, error) {
+	if sr.chunks == 0 {
+		return 0, io.EOF
+	}
+	sr.chunks--
+	time.Sleep(20 * time.Millisecond)
+	return len(p), nil
+}
+
+// Test other messages are not blocked by a payload being transferred
+func TestSendReaderInterleave(t *testing.T) {
+	m := startMesh(t, 1, 2)
+	defer stopMesh(m)
+
+	transferred := make(chan error, 1)
+	go func() {
+		_, err := m[1].SendReader(2, 0, &slowReader{chunks: 10})
+		transferred <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// the receiver of mesh 2 replies to the request while still receiving the payload
+	reply, err := m[1].Send(2, NewMessage(MsgRequireReply+1, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Bytes()[0] != 2 {
+		t.Fatal("error recv!")
+	}
+	select {
+	case <-transferred:
+		t.Fatal("the request waited for the whole payload")
+	default:
+	}
+	if err := <-transferred; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Test a one-way payload the handler does not read does not keep
+// the receiver from shutting down
+func TestSendReaderUnread(t *testing.T) {
+	r := NewReceiver("127.0.0.1:0")
+	if err := r.GoStart(); err != nil {
+		t.Fatal(err)
+	}
+
+	sender, err := NewSender(r.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	go sender.SendReader(1, bytes.NewReader(make([]byte, 4*chunkBufSize*ChunkSize)))
+	r.Recv()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := r.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
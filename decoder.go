@@ -2,9 +2,11 @@ package message
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
 	"io"
 	"reflect"
+	"time"
 
 	"code.google.com/p/gogoprotobuf/proto"
 )
@@ -19,19 +21,165 @@ func NewMsgDecoder(r io.Reader) *MsgDecoder {
 	}
 }
 
+// parseHeader parses the frame header at the start of b, n is 0
+// if b is too short to hold it. The flags of a plain frame are
+// implied by its type.
+func parseHeader(b []byte) (msgType uint16, flags uint8, size uint32, n int) {
+	if len(b) < plainHeaderSize {
+		return
+	}
+	if !isExtended(b) {
+		msgType = uint16(b[0])
+		if msgType > MsgRequireReply {
+			flags = flagRequireReply
+		}
+		return msgType, flags, binary.LittleEndian.Uint32(b[1:]), plainHeaderSize
+	}
+	if len(b) < extendedHeaderSize {
+		return
+	}
+	flags = b[1]
+	msgType = binary.LittleEndian.Uint16(b[2:])
+	return msgType, flags, binary.LittleEndian.Uint32(b[5:]), extendedHeaderSize
+}
+
+// isExtended reports whether the frame whose first plainHeaderSize
+// bytes are b is in the extended format, and not a plain frame of type 255
+func isExtended(b []byte) bool {
+	return b[0] == extendedMarker && b[4] == extendedMarker
+}
+
+// readHeader reads the frame header and the optional fields into fm
+func (md *MsgDecoder) readHeader(fm *frameMeta) (size uint32, err error) {
+	var hdr [extendedHeaderSize]byte
+	// io.EOF if the stream ends between frames
+	if _, err = io.ReadFull(md.br, hdr[:plainHeaderSize]); err != nil {
+		return
+	}
+
+	n := plainHeaderSize
+	if isExtended(hdr[:]) {
+		n = extendedHeaderSize
+		if _, err = io.ReadFull(md.br, hdr[plainHeaderSize:n]); err != nil {
+			return
+		}
+	}
+	var flags uint8
+	fm.msgType, flags, size, _ = parseHeader(hdr[:n])
+	fm.requireReply = flags&flagRequireReply != 0
+	if flags&^knownFlags != 0 {
+		err = ErrBadFrame
+		return
+	}
+	if err = checkSize(fm.msgType, int(size)); err != nil {
+		return
+	}
+	err = md.readExt(fm, flags)
+	return
+}
+
+// readExt reads the optional fields which follow the extended header
+func (md *MsgDecoder) readExt(fm *frameMeta, flags uint8) error {
+	fm.expires, fm.header = time.Time{}, nil
+	fm.priority, fm.prioritySet = 0, false
+	if flags&flagExpiry != 0 {
+		var exp int64
+		if err := binary.Read(md.br, binary.LittleEndian, &exp); err != nil {
+			return err
+		}
+		fm.expires = time.Unix(0, exp)
+	}
+	if flags&flagPriority != 0 {
+		p, err := md.br.ReadByte()
+		if err != nil {
+			return err
+		}
+		fm.priority, fm.prioritySet = int(int8(p)), true
+	}
+	if flags&flagHeader != 0 {
+		header, err := md.readHeaderBlock()
+		if err != nil {
+			return err
+		}
+		fm.header = header
+	}
+	return nil
+}
+
+func (md *MsgDecoder) readHeaderBlock() (Header, error) {
+	var size uint32
+	if err := binary.Read(md.br, binary.LittleEndian, &size); err != nil {
+		return nil, err
+	}
+	if size > maxHeaderSize {
+		return nil, ErrHeaderTooLarge
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(md.br, b); err != nil {
+		return nil, err
+	}
+	return unmarshalHeader(b)
+}
+
+// frameLen returns the length of the frame at the start of b,
+// or 0 if b does not hold all of it yet
+func frameLen(b []byte) (int, error) {
+	msgType, flags, size, n := parseHeader(b)
+	if n == 0 {
+		return 0, nil
+	}
+	if flags&^knownFlags != 0 {
+		return 0, ErrBadFrame
+	}
+	if err := checkSize(msgType, int(size)); err != nil {
+		return 0, err
+	}
+	if flags&flagExpiry != 0 {
+		n += 8
+	}
+	if flags&flagPriority != 0 {
+		n++
+	}
+	if flags&flagHeader != 0 {
+		if len(b) < n+4 {
+			return 0, nil
+		}
+		blockSize := binary.LittleEndian.Uint32(b[n:])
+		if blockSize > maxHeaderSize {
+			return 0, ErrHeaderTooLarge
+		}
+		n += 4 + int(blockSize)
+	}
+	n += int(size)
+	if len(b) < n {
+		return 0, nil
+	}
+	return n, nil
+}
+
+// decodeBytes decodes a message from a whole frame
+func decodeBytes(b []byte, m *Message) error {
+	md := &MsgDecoder{br: bufio.NewReaderSize(bytes.NewReader(b), 16)}
+	return md.Decode(m)
+}
+
 func (md *MsgDecoder) DecodePb(m *PbMessage) error {
-	msgType, err := md.br.ReadByte()
+	size, err := md.readHeader(&m.frameMeta)
 
 	if err != nil {
 		return err
 	}
 
-	m.msgType = uint8(msgType)
+	if size == 0 { // no need to read and unmarshal
+		m.pb = nil
+		return nil
+	}
 
 	t, ok := registry[m.msgType]
 
 	if !ok {
-		panic("unknown type") // TODO error handle
+		// the peer may be any client, e.g. over WebSocket
+		return ErrUnknownType
 	}
 
 	// since reflect.New() returns a pointer type,
@@ -39,13 +187,6 @@ func (md *MsgDecoder) DecodePb(m *PbMessage) error {
 	v := reflect.New(t)
 	m.pb = v.Interface().(proto.Message)
 
-	var size uint32
-	err = binary.Read(md.br, binary.LittleEndian, &size)
-	if size == 0 || err != nil { // no need to read and unmarshal
-		m.pb = nil
-		return err
-	}
-
 	bytes := make([]byte, size)
 	_, err = io.ReadFull(md.br, bytes)
 	if err != nil {
@@ -56,20 +197,12 @@ func (md *MsgDecoder) DecodePb(m *PbMessage) error {
 }
 
 func (md *MsgDecoder) Decode(m *Message) error {
-	msgType, err := md.br.ReadByte()
+	size, err := md.readHeader(&m.frameMeta)
 
 	if err != nil {
 		return err
 	}
 
-	m.msgType = uint8(msgType)
-
-	var size uint32
-	err = binary.Read(md.br, binary.LittleEndian, &size)
-	if err != nil {
-		return err
-	}
-
 	m.bytes = make([]byte, size)
 	_, err = io.ReadFull(md.br, m.bytes)
 	return err
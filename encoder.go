@@ -8,6 +8,67 @@ import (
 	"code.google.com/p/gogoprotobuf/proto"
 )
 
+// Messages are encoded in the plain format:
+//
+//	msgType uint8
+//	size    uint32
+//	bytes   [size]byte
+//
+// unless their type does not fit in a byte, they require reply against
+// the MsgRequireReply rule, or they carry a header, an expiry or a
+// priority, then in the extended format:
+//
+//	marker   uint8   0xff
+//	flags    uint8   flagRequireReply | flagHeader | flagExpiry | flagPriority
+//	msgType  uint16
+//	marker   uint8   0xff
+//	size     uint32
+//	expires  int64   unix nanoseconds, if flagExpiry is set
+//	priority int8    if flagPriority is set
+//	header   block, if flagHeader is set, see Header
+//	bytes    [size]byte
+//
+// A plain frame of type 255 starts with the marker too. The second
+// marker tells the formats apart, as it would be the top byte of the
+// size of the plain frame: plain frames of type 255 hold less than
+// 0xff000000 bytes, larger ones are sent in the extended format.
+const (
+	plainHeaderSize    = 5
+	extendedHeaderSize = 9
+
+	extendedMarker   = 0xff
+	flagRequireReply = 1
+	flagHeader       = 2
+	flagExpiry       = 4
+	flagPriority     = 8
+
+	knownFlags = flagRequireReply | flagHeader | flagExpiry | flagPriority
+)
+
+// flags returns the flags of a message in the extended format
+func (fm *frameMeta) flags() (flags uint8) {
+	if fm.requireReply {
+		flags |= flagRequireReply
+	}
+	if len(fm.header) > 0 {
+		flags |= flagHeader
+	}
+	if !fm.expires.IsZero() {
+		flags |= flagExpiry
+	}
+	if fm.prioritySet {
+		flags |= flagPriority
+	}
+	return
+}
+
+// extended reports whether a message has to be sent in the extended format
+func extended(msgType uint16, flags uint8, size int) bool {
+	return msgType > 0xff || flags&^flagRequireReply != 0 ||
+		(flags&flagRequireReply != 0) != (msgType > MsgRequireReply) ||
+		msgType == extendedMarker && uint32(size)>>24 == extendedMarker
+}
+
 type MsgEncoder struct {
 	bw *bufio.Writer
 }
@@ -18,23 +79,70 @@ func NewMsgEncoder(w io.Writer) *MsgEncoder {
 	}
 }
 
-func (me *MsgEncoder) EncodePb(m *PbMessage) error {
-	err := me.bw.WriteByte(byte(m.msgType))
+func (me *MsgEncoder) writeHeader(fm *frameMeta, size int) error {
+	if err := checkSize(fm.msgType, size); err != nil {
+		// nothing is written, the stream is still usable
+		return err
+	}
+
+	flags := fm.flags()
+	var hdr [extendedHeaderSize]byte
+	if !extended(fm.msgType, flags, size) {
+		hdr[0] = byte(fm.msgType)
+		binary.LittleEndian.PutUint32(hdr[1:], uint32(size))
+		_, err := me.bw.Write(hdr[:plainHeaderSize])
+		return err
+	}
+
+	ext, err := fm.marshalExt(flags)
 	if err != nil {
 		return err
 	}
 
+	hdr[0] = extendedMarker
+	hdr[1] = flags
+	binary.LittleEndian.PutUint16(hdr[2:], fm.msgType)
+	hdr[4] = extendedMarker
+	binary.LittleEndian.PutUint32(hdr[5:], uint32(size))
+	if _, err := me.bw.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err = me.bw.Write(ext)
+	return err
+}
+
+// marshalExt returns the optional fields which follow the extended header
+func (fm *frameMeta) marshalExt(flags uint8) ([]byte, error) {
+	var b []byte
+	if flags&flagExpiry != 0 {
+		var exp [8]byte
+		binary.LittleEndian.PutUint64(exp[:], uint64(fm.expires.UnixNano()))
+		b = append(b, exp[:]...)
+	}
+	if flags&flagPriority != 0 {
+		b = append(b, byte(int8(fm.priority)))
+	}
+	if flags&flagHeader != 0 {
+		block, err := fm.header.marshal()
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, block...)
+	}
+	return b, nil
+}
+
+func (me *MsgEncoder) EncodePb(m *PbMessage) error {
 	var bytes []byte
+	var err error
 	if m.pb != nil {
 		bytes, err = proto.Marshal(m.pb)
 		if err != nil {
 			return err
 		}
 	}
-	size := len(bytes)
-
-	err = binary.Write(me.bw, binary.LittleEndian, uint32(size))
 
+	err = me.writeHeader(&m.frameMeta, len(bytes))
 	if err != nil {
 		return err
 	}
@@ -45,14 +153,7 @@ func (me *MsgEncoder) EncodePb(m *PbMessage) error {
 }
 
 func (me *MsgEncoder) Encode(m *Message) error {
-	err := me.bw.WriteByte(byte(m.msgType))
-	if err != nil {
-		return err
-	}
-
-	size := len(m.bytes)
-	err = binary.Write(me.bw, binary.LittleEndian, uint32(size))
-
+	err := me.writeHeader(&m.frameMeta, len(m.bytes))
 	if err != nil {
 		return err
 	}
@@ -61,3 +162,27 @@ func (me *MsgEncoder) Encode(m *Message) error {
 
 	return me.bw.Flush()
 }
+
+// notWritten reports whether an encoding error was returned before
+// anything was written, so that the stream is still usable
+func notWritten(err error) bool {
+	return err == ErrMsgSize || err == ErrHeaderTooLarge
+}
+
+// broken reports whether a send failed with an error which leaves the
+// connection unusable, unlike encoding errors before anything was
+// written and errors replied by the receiver
+func broken(err error) bool {
+	return err != nil && !notWritten(err) && !replied(err)
+}
+
+// check returns the error encoding m would fail with before writing
+func (m *Message) check() error {
+	if err := checkSize(m.msgType, len(m.bytes)); err != nil {
+		return err
+	}
+	if m.header.size() > maxHeaderSize {
+		return ErrHeaderTooLarge
+	}
+	return nil
+}
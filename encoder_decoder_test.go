@@ -90,3 +90,66 @@ func TestPbEncoderAndDecoder(t *testing.T) {
 		t.Fatal("Protos are not equal!")
 	}
 }
+
+// Test messages outside the one-byte rule round trip in the extended format
+func TestExtendedEncoderAndDecoder(t *testing.T) {
+	msgs := []*Message{
+		NewMessage(1000, []byte("one-way")),
+		NewRequest(1000, []byte("request")),
+		NewRequest(1, []byte("request of a one-way type")),
+		NewMessage(255, []byte("marker type")),
+	}
+
+	buf := new(bytes.Buffer)
+	e := NewMsgEncoder(buf)
+	for _, msg := range msgs {
+		if err := e.Encode(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d := NewMsgDecoder(buf)
+	for _, msg := range msgs {
+		outMsg := NewEmptyMessage()
+		if err := d.Decode(outMsg); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(msg, outMsg) {
+			t.Fatal("Messages are not equal!")
+		}
+	}
+}
+
+// Test frames of the one-byte format still decode
+func TestPlainFrameDecode(t *testing.T) {
+	d := NewMsgDecoder(bytes.NewReader([]byte{MsgRequireReply + 1, 2, 0, 0, 0, 'h', 'i'}))
+	msg := NewEmptyMessage()
+	if err := d.Decode(msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type() != MsgRequireReply+1 || !msg.RequireReply() || string(msg.Bytes()) != "hi" {
+		t.Fatal("error decode!")
+	}
+}
+
+// Test plain frames of type 255 are not taken for extended frames
+func TestPlainFrame255Decode(t *testing.T) {
+	buf := bytes.NewBuffer([]byte{255, 3, 0, 0, 0, 'o', 'l', 'd'})
+	if err := NewMsgEncoder(buf).Encode(NewMessage(1000, []byte("new"))); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := frameLen(buf.Bytes()); n != plainHeaderSize+3 || err != nil {
+		t.Fatal("unexpected frame length ", n, err)
+	}
+
+	d := NewMsgDecoder(buf)
+	for _, expect := range []*Message{NewMessage(255, []byte("old")), NewMessage(1000, []byte("new"))} {
+		msg := NewEmptyMessage()
+		if err := d.Decode(msg); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(expect, msg) {
+			t.Fatal("Messages are not equal!")
+		}
+	}
+}
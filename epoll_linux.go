@@ -0,0 +1,472 @@
+//go:build linux
+// +build linux
+
+package message
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/coreos/go-log/log"
+)
+
+const (
+	epollBufSize   = 64 * 1024 // read buffer shared by all connections of a loop
+	epollMaxEvents = 128
+	epollTimeout   = 500 // ms, how often a loop checks whether the receiver stopped
+
+	epollReadEvents = syscall.EPOLLIN | syscall.EPOLLRDHUP
+)
+
+// epollLoop serves many connections from one goroutine
+type epollLoop struct {
+	r      *Receiver
+	epfd   int
+	buf    []byte
+	mu     sync.Mutex
+	conns  map[int]*epollConn
+	closed bool // epfd is closed, connections are no longer added
+}
+
+// epollConn only keeps the bytes of a partially received frame,
+// an idle connection costs no buffers and no goroutine.
+type epollConn struct {
+	loop    *epollLoop
+	fd      int
+	in      *inbound // queue of the received messages
+	mu      sync.Mutex
+	pending []byte
+	busy    bool // frames are being served, stop reading until they are
+	eof     bool // peer is gone, close once the frames are served
+	closed  bool
+}
+
+// GoStartEpoll is like StartEpoll, but serves the connections on a
+// goroutine of its own, see GoStart
+func (r *Receiver) GoStartEpoll(loops int) error {
+	ln, ls, err := r.listenEpoll(loops)
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := r.serveEpoll(ln, ls); err != nil {
+			log.Error("Accept() error: ", err)
+		}
+	}()
+	return nil
+}
+
+// StartEpoll is an alternative to Start for tens of thousands of mostly
+// idle connections. Instead of a goroutine with its own reader and writer
+// per connection, accepted connections are spread over a small number of
+// epoll loops. loops <= 0 means one loop per CPU. Connections switching
+// to the session format, e.g. to accept pushes or flow control, are
+// served on goroutines of their own as by Start.
+func (r *Receiver) StartEpoll(loops int) error {
+	ln, ls, err := r.listenEpoll(loops)
+	if err != nil {
+		return err
+	}
+	return r.serveEpoll(ln, ls)
+}
+
+// listenEpoll listens and starts the epoll loops
+func (r *Receiver) listenEpoll(loops int) (net.Listener, []*epollLoop, error) {
+	if loops <= 0 {
+		loops = runtime.NumCPU()
+	}
+
+	ln, err := r.Listen()
+	if err != nil {
+		return nil, nil, err
+	}
+	ls := make([]*epollLoop, loops)
+	for i := range ls {
+		l, err := newEpollLoop(r)
+		if err != nil {
+			ln.Close()
+			for _, l := range ls[:i] {
+				l.close()
+			}
+			return nil, nil, err
+		}
+		ls[i] = l
+	}
+	r.lc.listen(ln)
+
+	closed := r.lc.closedChan()
+	for _, l := range ls {
+		// the loops serve the connections until they are closed
+		r.lc.wg.Add(1)
+		go l.run(closed)
+	}
+	return ln, ls, nil
+}
+
+// serveEpoll hands the accepted connections to the loops in turn
+func (r *Receiver) serveEpoll(ln net.Listener, ls []*epollLoop) error {
+	var next uint32
+	return r.lc.accept(ln, func(conn net.Conn) {
+		l := ls[atomic.AddUint32(&next, 1)%uint32(len(ls))]
+		if err := l.add(conn.(*net.TCPConn)); err != nil {
+			log.Warning("StartEpoll() error: ", err)
+		}
+	})
+}
+
+func newEpollLoop(r *Receiver) (*epollLoop, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	return &epollLoop{
+		r:     r,
+		epfd:  epfd,
+		buf:   make([]byte, epollBufSize),
+		conns: make(map[int]*epollConn),
+	}, nil
+}
+
+// add takes the file descriptor over from conn and closes conn.
+// It fails once the loop is closed.
+func (l *epollLoop) add(conn *net.TCPConn) error {
+	defer conn.Close()
+
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	fd := -1
+	err = raw.Control(func(s uintptr) {
+		fd, err = syscall.Dup(int(s))
+	})
+	if err != nil {
+		return err
+	}
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return err
+	}
+
+	c := &epollConn{loop: l, fd: fd, in: l.r.q.newInbound(conn.RemoteAddr())}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		syscall.Close(fd)
+		return ErrReceiverClosed
+	}
+	ev := &syscall.EpollEvent{Events: epollReadEvents, Fd: int32(fd)}
+	if err := syscall.EpollCtl(l.epfd, syscall.EPOLL_CTL_ADD, fd, ev); err != nil {
+		syscall.Close(fd)
+		return err
+	}
+	l.conns[fd] = c
+	return nil
+}
+
+// run serves the connections of the loop until closed is closed
+func (l *epollLoop) run(closed <-chan struct{}) {
+	defer l.r.lc.wg.Done()
+
+	events := make([]syscall.EpollEvent, epollMaxEvents)
+	for {
+		n, err := syscall.EpollWait(l.epfd, events, epollTimeout)
+		select {
+		case <-closed:
+			l.close()
+			return
+		default:
+		}
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			log.Error("EpollWait() error: ", err)
+			l.close()
+			return
+		}
+
+		for i := 0; i < n; i++ {
+			l.mu.Lock()
+			c := l.conns[int(events[i].Fd)]
+			l.mu.Unlock()
+			if c != nil {
+				c.readable()
+			}
+		}
+	}
+}
+
+// close closes the loop and its idle connections. Busy connections are
+// shut down, and closed by the goroutine serving them once it is done.
+func (l *epollLoop) close() {
+	l.mu.Lock()
+	l.closed = true
+	syscall.Close(l.epfd)
+	conns := make([]*epollConn, 0, len(l.conns))
+	for _, c := range l.conns {
+		conns = append(conns, c)
+	}
+	l.mu.Unlock()
+
+	for _, c := range conns {
+		c.mu.Lock()
+		if c.busy {
+			c.eof = true
+			syscall.Shutdown(c.fd, syscall.SHUT_RDWR)
+		} else {
+			c.close()
+		}
+		c.mu.Unlock()
+	}
+}
+
+// ctl changes the events the loop waits for on the connection,
+// it fails once the loop is closed
+func (c *epollConn) ctl(events uint32) error {
+	l := c.loop
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return ErrReceiverClosed
+	}
+	ev := &syscall.EpollEvent{Events: events, Fd: int32(c.fd)}
+	return syscall.EpollCtl(l.epfd, syscall.EPOLL_CTL_MOD, c.fd, ev)
+}
+
+// detach removes the connection from the loop without closing its
+// file descriptor. c.mu must be held.
+func (c *epollConn) detach() {
+	c.closed = true
+	c.pending = nil
+	l := c.loop
+	l.mu.Lock()
+	delete(l.conns, c.fd)
+	if !l.closed {
+		syscall.EpollCtl(l.epfd, syscall.EPOLL_CTL_DEL, c.fd, nil)
+	}
+	l.mu.Unlock()
+}
+
+// close closes the connection once, c.mu must be held
+func (c *epollConn) close() {
+	if c.closed {
+		return
+	}
+	c.detach()
+	syscall.Close(c.fd)
+}
+
+// readable drains the socket into the loop's shared buffer
+// and processes every complete frame
+func (c *epollConn) readable() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+
+	buf := c.loop.buf
+	for {
+		n, err := syscall.Read(c.fd, buf)
+		if n > 0 {
+			c.pending = append(c.pending, buf[:n]...)
+			if n == len(buf) {
+				continue
+			}
+		}
+		if err == syscall.EINTR {
+			continue
+		}
+		if n == 0 && err == nil || err != nil && err != syscall.EAGAIN {
+			// EOF or broken connection, the frames received are served
+			c.eof = true
+		}
+		break
+	}
+	c.process()
+	if c.eof && !c.busy {
+		c.close()
+	}
+}
+
+// fail drops a connection which sent a frame that can not be decoded.
+// c.mu must be held.
+func (c *epollConn) fail(err error) {
+	log.Warning("process() error: ", err)
+	c.close()
+}
+
+// process starts serving the complete frames received. Delivering a
+// message may block, e.g. on a full queue or a rate limit, so frames are
+// served on a goroutine of their own while the loop stops reading the
+// connection. c.mu must be held.
+func (c *epollConn) process() {
+	if c.busy || c.closed {
+		return
+	}
+	if bytes.HasPrefix(c.pending, sessionPreamble) {
+		c.handOff()
+		return
+	}
+	n, err := frameLen(c.pending)
+	if err != nil {
+		c.fail(err)
+		return
+	}
+	if n == 0 {
+		if len(c.pending) == 0 {
+			// release the memory of an idle connection
+			c.pending = nil
+		}
+		return
+	}
+
+	// level triggered, the loop would spin on unread data
+	if err := c.ctl(0); err != nil {
+		c.fail(err)
+		return
+	}
+	c.busy = true
+	c.loop.r.lc.wg.Add(1)
+	go c.serve()
+}
+
+// serve delivers the complete frames one at a time, and waits for the
+// reply of every request before the next, as handleConn does
+func (c *epollConn) serve() {
+	defer c.loop.r.lc.wg.Done()
+
+	for {
+		msg := c.next()
+		if msg == nil {
+			return
+		}
+		attached := msg.AttachReplyChan()
+		if attached {
+			c.loop.r.lc.begin()
+		}
+
+		// send received message for processing
+		c.loop.r.deliver(c.in, msg)
+
+		if attached {
+			c.reply(msg)
+			c.loop.r.lc.end()
+		}
+	}
+}
+
+// next decodes the next complete frame. If there is none, it returns
+// nil and the loop resumes reading the connection, unless it is closed.
+func (c *epollConn) next() *Message {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+
+	if !bytes.HasPrefix(c.pending, sessionPreamble) {
+		n, err := frameLen(c.pending)
+		if err != nil {
+			c.fail(err)
+			return nil
+		}
+		if n > 0 {
+			msg := NewEmptyMessage()
+			if err := decodeBytes(c.pending[:n], msg); err != nil {
+				c.fail(err)
+				return nil
+			}
+			c.pending = c.pending[n:]
+			return msg
+		}
+	}
+
+	c.busy = false
+	switch {
+	case c.eof:
+		c.close()
+	case bytes.HasPrefix(c.pending, sessionPreamble):
+		c.handOff()
+	default:
+		if len(c.pending) == 0 {
+			c.pending = nil
+		}
+		if err := c.ctl(epollReadEvents); err != nil {
+			c.fail(err)
+		}
+	}
+	return nil
+}
+
+// reply waits for the reply of msg and writes it
+func (c *epollConn) reply(msg *Message) {
+	replyMsg := <-msg.reply
+	if replyMsg == nil {
+		return
+	}
+	checkReply(msg.msgType, replyMsg.msgType)
+	buf := new(bytes.Buffer)
+	NewMsgEncoder(buf).Encode(replyMsg)
+	if err := c.write(buf.Bytes()); err != nil {
+		log.Warning("reply() error: ", err)
+	}
+}
+
+func (c *epollConn) write(p []byte) error {
+	for len(p) > 0 {
+		n, err := syscall.Write(c.fd, p)
+		if err == syscall.EAGAIN || err == syscall.EINTR {
+			// replies are small, the socket buffer is rarely full
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		p = p[n:]
+	}
+	return nil
+}
+
+// handOff serves a connection which switches to the session format on
+// goroutines of its own, as Start does. Sessions multiplex requests and
+// pushes over long lived connections, which the loops are not made for.
+// c.mu must be held.
+func (c *epollConn) handOff() {
+	pending := c.pending
+	c.detach()
+	f := os.NewFile(uintptr(c.fd), "epoll")
+	conn, err := net.FileConn(f)
+	f.Close()
+	if err != nil {
+		log.Warning("StartEpoll() error: ", err)
+		return
+	}
+
+	pc := &prefixConn{Conn: conn, r: io.MultiReader(bytes.NewReader(pending), conn)}
+	lc := c.loop.r.lc
+	if lc.track(pc) {
+		go func() {
+			defer lc.untrack(pc)
+			c.loop.r.handleConn(pc)
+		}()
+	}
+}
+
+// prefixConn is a net.Conn which returns the bytes already
+// received from it before reading it again
+type prefixConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *prefixConn) Read(p []byte) (int, error) { return c.r.Read(p) }
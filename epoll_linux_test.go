@@ -0,0 +1,197 @@
+//go:build linux
+// +build linux
+
+package message
+
+import (
+	"context"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestEpollRecv(t *testing.T) {
+	buf, msg := initMsg(t)
+	secBuf, _ := initMsg(t)
+	secBuf.WriteTo(buf) // write second message
+
+	r := NewReceiver("127.0.0.1:0")
+	if err := r.GoStartEpoll(2); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	send(r.Addr().String(), buf, t)
+	for i := 0; i < 2; i++ {
+		compareMsg(msg, r.Recv(), t)
+	}
+}
+
+func TestEpollSendAndReply(t *testing.T) {
+	r := NewReceiver("127.0.0.1:0")
+	if err := r.GoStartEpoll(1); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	go func() {
+		for {
+			msg := r.Recv()
+			msg.reply <- NewMessage(0, append([]byte("a reply to "), msg.bytes...))
+		}
+	}()
+
+	for i := 0; i < 3; i++ {
+		sendAndRecv(r.Addr().String(), t)
+	}
+}
+
+// Test a connection blocked on its full queue does not stall the
+// other connections of its loop
+func TestEpollFullQueue(t *testing.T) {
+	r := NewReceiver("127.0.0.1:0")
+	r.SetQueue(QueueConfig{ConnSize: 2})
+	if err := r.GoStartEpoll(1); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	a, err := NewSender(r.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 12; i++ {
+		if _, err := a.Send(NewMessage(1, nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := NewSender(r.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Send(NewMessage(2, nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for len(r.PeerQueueStats()) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("expect the message of the second connection to be queued")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Test connections switching to the session format are served
+func TestEpollSession(t *testing.T) {
+	r := NewReceiver("127.0.0.1:0")
+	if err := r.GoStartEpoll(1); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+	go echo(r)
+
+	sender, err := NewSender(r.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a plain request, then the session format
+	if _, err := sender.Send(NewRequest(1, []byte("plain"))); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		reply, err := sender.SendContext(ctx, NewRequest(1, []byte("session")))
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(reply.Bytes()) != "session" {
+			t.Fatal("unexpected reply ", string(reply.Bytes()))
+		}
+	}
+}
+
+// Test connections are not added to a closed loop
+func TestEpollAddClosed(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := newEpollLoop(NewReceiver(":0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.close()
+	if err := l.add(conn.(*net.TCPConn)); err != ErrReceiverClosed {
+		t.Fatal("expect ErrReceiverClosed, got ", err)
+	}
+}
+
+// Compare the memory cost of idle connections with one goroutine per
+// connection and with epoll loops
+func BenchmarkIdleConnGoroutine(b *testing.B) {
+	r := NewReceiver("127.0.0.1:0")
+	if err := r.GoStart(); err != nil {
+		b.Fatal(err)
+	}
+	defer r.Stop()
+	go drain(r)
+	benchIdleConns(b, r.Addr().String())
+}
+
+func BenchmarkIdleConnEpoll(b *testing.B) {
+	r := NewReceiver("127.0.0.1:0")
+	if err := r.GoStartEpoll(0); err != nil {
+		b.Fatal(err)
+	}
+	defer r.Stop()
+	go drain(r)
+	benchIdleConns(b, r.Addr().String())
+}
+
+func benchIdleConns(b *testing.B, addr string) {
+	const n = 2000
+
+	before := memInUse()
+	conns := make([]net.Conn, 0, n)
+	for i := 0; i < n; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			b.Fatal(err)
+		}
+		conns = append(conns, conn)
+	}
+	// a message makes the receiver allocate its buffers
+	for _, conn := range conns {
+		NewMsgEncoder(conn).Encode(NewMessage(0, nil))
+	}
+	time.Sleep(500 * time.Millisecond) // wait for the receiver to accept all
+	after := memInUse()
+
+	b.ReportMetric(float64(after-before)/n, "B/conn")
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+func drain(r *Receiver) {
+	for {
+		r.Recv()
+	}
+}
+
+// memInUse counts heap and goroutine stacks
+func memInUse() uint64 {
+	var ms runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&ms)
+	return ms.HeapInuse + ms.StackInuse
+}
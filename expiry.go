@@ -0,0 +1,53 @@
+package message
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrExpired = errors.New("message: expired before delivery")
+)
+
+// SetTTL makes the message expire d from now, see SetExpiry
+func (m *frameMeta) SetTTL(d time.Duration) { m.expires = time.Now().Add(d) }
+
+// SetExpiry sets the time after which the message is stale. A receiver
+// drops a message that expires before Recv returns it, replying with
+// ErrExpired if the message requires reply. The expiry is sent as wall
+// clock time, so the clocks of the hosts should be synchronized.
+func (m *frameMeta) SetExpiry(t time.Time) { m.expires = t }
+
+// Expiry returns the time the message expires, zero if it does not
+func (m *frameMeta) Expiry() time.Time { return m.expires }
+
+func (m *frameMeta) Expired() bool {
+	return !m.expires.IsZero() && time.Now().After(m.expires)
+}
+
+// dropExpired drops m if it is expired
+func (r *Receiver) dropExpired(m *Message) bool {
+	if !m.Expired() {
+		return false
+	}
+	atomic.AddUint64(&r.expired, 1)
+	m.fail(ErrExpired)
+	return true
+}
+
+// ExpiredCount returns the number of expired messages dropped
+func (r *Receiver) ExpiredCount() uint64 { return atomic.LoadUint64(&r.expired) }
+
+// dropExpired drops m if it is expired
+func (r *PbReceiver) dropExpired(m *PbMessage) bool {
+	if !m.Expired() {
+		return false
+	}
+	atomic.AddUint64(&r.expired, 1)
+	m.fail(ErrExpired)
+	return true
+}
+
+// ExpiredCount returns the number of expired messages dropped
+func (r *PbReceiver) ExpiredCount() uint64 { return atomic.LoadUint64(&r.expired) }
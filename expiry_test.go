@@ -0,0 +1,72 @@
+package message
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestExpiryEncoderAndDecoder(t *testing.T) {
+	msg := NewMessage(1, []byte("hello"))
+	msg.SetTTL(time.Second)
+
+	buf := new(bytes.Buffer)
+	if err := NewMsgEncoder(buf).Encode(msg); err != nil {
+		t.Fatal(err)
+	}
+	outMsg := NewEmptyMessage()
+	if err := NewMsgDecoder(buf).Decode(outMsg); err != nil {
+		t.Fatal(err)
+	}
+	if !outMsg.Expiry().Equal(msg.Expiry()) || string(outMsg.Bytes()) != "hello" {
+		t.Fatal("Messages are not equal!")
+	}
+}
+
+func TestRecvDropsExpired(t *testing.T) {
+	r := NewReceiver("127.0.0.1:0")
+
+	stale := NewMessage(1, []byte("stale"))
+	stale.SetExpiry(time.Now().Add(-time.Millisecond))
+	SendTo(r, stale)
+	SendTo(r, NewMessage(1, []byte("fresh")))
+
+	if msg := r.Recv(); string(msg.Bytes()) != "fresh" {
+		t.Fatal("expect the stale message to be dropped")
+	}
+	if r.ExpiredCount() != 1 {
+		t.Fatal("expect 1 expired message, got ", r.ExpiredCount())
+	}
+}
+
+// Test a request which expires while the handler is busy is replied with ErrExpired
+func TestSendExpired(t *testing.T) {
+	r := NewReceiver("127.0.0.1:0")
+	if err := r.GoStart(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	sender, err := NewSender(r.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		echo(r)
+	}()
+	msg := NewMessage(MsgRequireReply+1, []byte("hello"))
+	msg.SetTTL(10 * time.Millisecond)
+	if _, err := sender.Send(msg); err != ErrExpired {
+		t.Fatal("expect ErrExpired, got ", err)
+	}
+
+	msg.SetTTL(time.Second)
+	reply, err := sender.Send(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply.Bytes()) != "hello" {
+		t.Fatal("error recv!")
+	}
+}
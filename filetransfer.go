@@ -0,0 +1,387 @@
+package message
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-log/log"
+)
+
+// File transfer requests are messages of a single request type chosen
+// by the application, with payload:
+//
+//	op      uint8
+//	nameLen uint16
+//	name    [nameLen]byte
+//	offset  uint64  of data, or the file size for fileStat and fileCommit
+//	crc     uint32  IEEE checksum of data, or of the file for fileStat and fileCommit
+//	data    []byte
+//
+// and replies with payload:
+//
+//	status  uint8
+//	offset  uint64  bytes of the file the service has
+//	errmsg  []byte
+const (
+	fileStat   = iota // ask for the offset to resume from
+	fileWrite         // write data at offset
+	fileCommit        // the file is complete
+)
+
+const (
+	fileOK = iota
+	fileBadChecksum
+	fileBadOffset
+	fileError
+)
+
+const (
+	DefaultFileChunkSize = 32 * 1024
+	DefaultFileRetries   = 5
+
+	fileRetryDelay = 100 * time.Millisecond
+	partSuffix     = ".part"
+	idSuffix       = ".id" // of the file the part is of, next to it
+)
+
+var (
+	ErrBadFileRequest = errors.New("message: bad file transfer request")
+	ErrFileChecksum   = errors.New("message: file chunk checksum mismatch")
+)
+
+type fileReq struct {
+	op     uint8
+	name   string
+	offset uint64
+	crc    uint32
+	data   []byte
+}
+
+func (fr *fileReq) marshal() []byte {
+	b := make([]byte, 1+2+len(fr.name)+8+4+len(fr.data))
+	b[0] = fr.op
+	binary.LittleEndian.PutUint16(b[1:], uint16(len(fr.name)))
+	n := 3 + copy(b[3:], fr.name)
+	binary.LittleEndian.PutUint64(b[n:], fr.offset)
+	binary.LittleEndian.PutUint32(b[n+8:], fr.crc)
+	copy(b[n+12:], fr.data)
+	return b
+}
+
+func (fr *fileReq) unmarshal(b []byte) error {
+	if len(b) < 3 {
+		return ErrBadFileRequest
+	}
+	fr.op = b[0]
+	n := 3 + int(binary.LittleEndian.Uint16(b[1:]))
+	if len(b) < n+12 {
+		return ErrBadFileRequest
+	}
+	fr.name = string(b[3:n])
+	fr.offset = binary.LittleEndian.Uint64(b[n:])
+	fr.crc = binary.LittleEndian.Uint32(b[n+8:])
+	fr.data = b[n+12:]
+	return nil
+}
+
+// fileID identifies the file a part is of by its size and checksum
+func fileID(size uint64, crc uint32) []byte {
+	b := make([]byte, 12)
+	binary.LittleEndian.PutUint64(b, size)
+	binary.LittleEndian.PutUint32(b[8:], crc)
+	return b
+}
+
+// fileChecksum returns the IEEE checksum of the first size bytes of f
+func fileChecksum(f io.ReaderAt, size int64) (uint32, error) {
+	h := crc32.NewIEEE()
+	if _, err := io.Copy(h, io.NewSectionReader(f, 0, size)); err != nil {
+		return 0, err
+	}
+	return h.Sum32(), nil
+}
+
+func fileReply(status uint8, offset uint64, err error) *Message {
+	b := make([]byte, 9)
+	b[0] = status
+	binary.LittleEndian.PutUint64(b[1:], offset)
+	if err != nil {
+		b = append(b, err.Error()...)
+	}
+	return NewMessage(0, b)
+}
+
+// FileService receives files sent by FileSenders into a directory.
+// A file is written to name.part and renamed to name once complete,
+// so that a transfer broken by a reconnect resumes where it stopped.
+// name.part.id records the size and checksum of the file being sent,
+// a part left by the transfer of another file is discarded, and the
+// checksum of the whole file is checked before it is renamed.
+type FileService struct {
+	dir     string
+	msgType uint16
+	mu      sync.Mutex // serializes writes
+}
+
+// NewFileService creates a file service for requests of msgType,
+// which must require reply
+func NewFileService(dir string, msgType uint16) *FileService {
+	return &FileService{
+		dir:     dir,
+		msgType: msgType,
+	}
+}
+
+// Handle replies to msg if it is a file transfer request,
+// it returns false for any other message
+func (fs *FileService) Handle(msg *Message) bool {
+	if msg.Type() != fs.msgType || !msg.RequireReply() {
+		return false
+	}
+	msg.reply <- fs.handle(msg.Bytes())
+	return true
+}
+
+func (fs *FileService) handle(b []byte) *Message {
+	var req fileReq
+	if err := req.unmarshal(b); err != nil {
+		return fileReply(fileError, 0, err)
+	}
+	// no way out of dir
+	if req.name == "" || filepath.Base(req.name) != req.name {
+		return fileReply(fileError, 0, ErrBadFileRequest)
+	}
+	part := filepath.Join(fs.dir, req.name+partSuffix)
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	var size uint64
+	if fi, err := os.Stat(part); err == nil {
+		size = uint64(fi.Size())
+	}
+
+	switch req.op {
+	case fileStat:
+		id := fileID(req.offset, req.crc)
+		if old, err := ioutil.ReadFile(part + idSuffix); err == nil && bytes.Equal(old, id) && size <= req.offset {
+			return fileReply(fileOK, size, nil)
+		}
+		// start over
+		if err := os.Remove(part); err != nil && !os.IsNotExist(err) {
+			return fileReply(fileError, size, err)
+		}
+		if err := ioutil.WriteFile(part+idSuffix, id, 0644); err != nil {
+			return fileReply(fileError, 0, err)
+		}
+		return fileReply(fileOK, 0, nil)
+	case fileWrite:
+		if req.offset != size {
+			return fileReply(fileBadOffset, size, nil)
+		}
+		if crc32.ChecksumIEEE(req.data) != req.crc {
+			return fileReply(fileBadChecksum, size, ErrFileChecksum)
+		}
+		f, err := os.OpenFile(part, os.O_WRONLY|os.O_CREATE, 0644)
+		if err != nil {
+			return fileReply(fileError, size, err)
+		}
+		defer f.Close()
+		if _, err := f.WriteAt(req.data, int64(req.offset)); err != nil {
+			return fileReply(fileError, size, err)
+		}
+		return fileReply(fileOK, size+uint64(len(req.data)), nil)
+	case fileCommit:
+		if req.offset != size {
+			return fileReply(fileBadOffset, size, nil)
+		}
+		if !fs.complete(part, &req) {
+			// the next fileStat starts over
+			os.Remove(part + idSuffix)
+			return fileReply(fileBadChecksum, size, ErrFileChecksum)
+		}
+		if err := os.Rename(part, filepath.Join(fs.dir, req.name)); err != nil {
+			return fileReply(fileError, size, err)
+		}
+		os.Remove(part + idSuffix)
+		return fileReply(fileOK, size, nil)
+	}
+	return fileReply(fileError, size, ErrBadFileRequest)
+}
+
+// complete reports whether part is the whole file the commit req is of
+func (fs *FileService) complete(part string, req *fileReq) bool {
+	id, err := ioutil.ReadFile(part + idSuffix)
+	if err != nil || !bytes.Equal(id, fileID(req.offset, req.crc)) {
+		return false
+	}
+	f, err := os.Open(part)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	crc, err := fileChecksum(f, int64(req.offset))
+	return err == nil && crc == req.crc
+}
+
+// FileSender sends files to the FileService of a remote receiver.
+// After the connection breaks it dials again and resumes from the
+// offset the service already has.
+type FileSender struct {
+	addr    string
+	msgType uint16
+	s       *Sender
+
+	ChunkSize int
+	Retries   int   // reconnects and resent chunks before giving up
+	Rate      int64 // bytes per second, 0 for unlimited
+
+	// Progress, if set, is called after every chunk with
+	// the bytes the service has and the file size
+	Progress func(sent, total int64)
+}
+
+// NewFileSender creates a file sender to the FileService of the receiver
+// at addr, which handles requests of msgType
+func NewFileSender(addr string, msgType uint16) *FileSender {
+	return &FileSender{
+		addr:      addr,
+		msgType:   msgType,
+		ChunkSize: DefaultFileChunkSize,
+		Retries:   DefaultFileRetries,
+	}
+}
+
+// Send sends the local file at path as name. The connection to the
+// service is closed once Send returns.
+func (fs *FileSender) Send(path, name string) error {
+	defer fs.close()
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	crc, err := fileChecksum(f, fi.Size())
+	if err != nil {
+		return err
+	}
+
+	for retries := 0; ; retries++ {
+		err = fs.transfer(f, name, fi.Size(), crc)
+		if err == nil || retries >= fs.Retries {
+			return err
+		}
+		if _, ok := err.(serviceError); ok {
+			// the service failed, resuming does not help
+			return err
+		}
+		log.Warning("FileSender.Send() error: ", err, ", resuming")
+		time.Sleep(fileRetryDelay)
+	}
+}
+
+// serviceError is an error reported by the file service
+type serviceError string
+
+func (e serviceError) Error() string { return string(e) }
+
+func (fs *FileSender) transfer(f *os.File, name string, size int64, crc uint32) error {
+	offset, err := fs.request(&fileReq{op: fileStat, name: name, offset: uint64(size), crc: crc})
+	if err != nil {
+		return err
+	}
+
+	start, startOffset := time.Now(), offset
+	buf := make([]byte, fs.ChunkSize)
+	badChecksums := 0
+	for offset < uint64(size) {
+		n, err := f.ReadAt(buf, int64(offset))
+		if err != nil && err != io.EOF {
+			return err
+		}
+		data := buf[:n]
+		next, err := fs.request(&fileReq{
+			op:     fileWrite,
+			name:   name,
+			offset: offset,
+			crc:    crc32.ChecksumIEEE(data),
+			data:   data,
+		})
+		if err == ErrFileChecksum && badChecksums < fs.Retries {
+			badChecksums++
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		offset = next
+
+		if fs.Progress != nil {
+			fs.Progress(int64(offset), size)
+		}
+		if fs.Rate > 0 {
+			// sleep until the average rate drops to Rate
+			expect := time.Duration(float64(offset-startOffset) / float64(fs.Rate) * float64(time.Second))
+			if d := expect - time.Since(start); d > 0 {
+				time.Sleep(d)
+			}
+		}
+	}
+
+	_, err = fs.request(&fileReq{op: fileCommit, name: name, offset: offset, crc: crc})
+	return err
+}
+
+// close closes the connection to the service, if any
+func (fs *FileSender) close() {
+	if fs.s != nil {
+		fs.s.Close()
+		fs.s = nil
+	}
+}
+
+// request sends a request to the service and returns the offset it replied,
+// a broken connection is dropped and dialed again by the next request
+func (fs *FileSender) request(req *fileReq) (uint64, error) {
+	if fs.s == nil {
+		s, err := NewSender(fs.addr)
+		if err != nil {
+			return 0, err
+		}
+		fs.s = s
+	}
+
+	reply, err := fs.s.Send(NewRequest(fs.msgType, req.marshal()))
+	if broken(err) {
+		fs.close()
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	b := reply.Bytes()
+	if len(b) < 9 {
+		return 0, ErrBadFileRequest
+	}
+	offset := binary.LittleEndian.Uint64(b[1:])
+	switch b[0] {
+	case fileOK, fileBadOffset:
+		// on a bad offset, continue from where the service is
+		return offset, nil
+	case fileBadChecksum:
+		return offset, ErrFileChecksum
+	}
+	return offset, serviceError(b[9:])
+}
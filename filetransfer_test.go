@@ -0,0 +1,181 @@
+package message
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const fileMsgType = MsgRequireReply + 10
+
+func serveFiles(r *Receiver, fs *FileService) {
+	for {
+		msg := r.Recv()
+		if !fs.Handle(msg) && msg.RequireReply() {
+			msg.reply <- NewMessage(0, msg.Bytes())
+		}
+	}
+}
+
+// startFileService starts a receiver on a free port storing files of
+// msgType into a new directory, and writes a random file of size bytes
+// to send to it
+func startFileService(t *testing.T, msgType uint16, size int) (r *Receiver, dir, path string) {
+	dir, err := ioutil.TempDir("", "message")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = NewReceiver("127.0.0.1:0")
+	if err := r.GoStart(); err != nil {
+		t.Fatal(err)
+	}
+	go serveFiles(r, NewFileService(dir, msgType))
+
+	data := make([]byte, size)
+	rand.Read(data)
+	path = filepath.Join(dir, "snapshot.src")
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return r, dir, path
+}
+
+func compareFiles(t *testing.T, a, b string) {
+	x, err := ioutil.ReadFile(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	y, err := ioutil.ReadFile(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(x, y) {
+		t.Fatal("files are not equal")
+	}
+}
+
+// Test a transfer broken by the connection resumes where it stopped
+func TestFileSendResume(t *testing.T) {
+	r, dir, path := startFileService(t, fileMsgType, 10*DefaultFileChunkSize+123)
+	defer os.RemoveAll(dir)
+	defer r.Stop()
+
+	fs := NewFileSender(r.Addr().String(), fileMsgType)
+	var last int64
+	broken := false
+	fs.Progress = func(sent, total int64) {
+		if sent < last {
+			t.Error("transfer restarted from ", sent, " after ", last)
+		}
+		last = sent
+		if !broken && sent >= 3*DefaultFileChunkSize {
+			broken = true
+			fs.s.closeConn()
+		}
+	}
+	if err := fs.Send(path, "snapshot"); err != nil {
+		t.Fatal(err)
+	}
+	if !broken {
+		t.Fatal("the transfer was not broken")
+	}
+	compareFiles(t, path, filepath.Join(dir, "snapshot"))
+	if _, err := os.Stat(filepath.Join(dir, "snapshot"+partSuffix)); !os.IsNotExist(err) {
+		t.Fatal("partial file is left")
+	}
+}
+
+func TestFileSendRate(t *testing.T) {
+	r, dir, path := startFileService(t, fileMsgType, 4*DefaultFileChunkSize)
+	defer os.RemoveAll(dir)
+	defer r.Stop()
+
+	fs := NewFileSender(r.Addr().String(), fileMsgType)
+	fs.Rate = 10 * DefaultFileChunkSize // 4 chunks take 400ms
+	start := time.Now()
+	if err := fs.Send(path, "snapshot"); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 350*time.Millisecond {
+		t.Fatal("transfer is not rate limited, took ", d)
+	}
+	compareFiles(t, path, filepath.Join(dir, "snapshot"))
+}
+
+func TestFileServiceChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "message")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs := NewFileService(dir, fileMsgType)
+
+	req := &fileReq{op: fileWrite, name: "snapshot", crc: 1, data: []byte("hello")}
+	if reply := fs.handle(req.marshal()); reply.Bytes()[0] != fileBadChecksum {
+		t.Fatal("expect a checksum mismatch")
+	}
+	req = &fileReq{op: fileWrite, name: "../snapshot", data: []byte("hello")}
+	if reply := fs.handle(req.marshal()); reply.Bytes()[0] != fileError {
+		t.Fatal("expect the name to be refused")
+	}
+}
+
+// Test a part left by another transfer is not taken for the file's
+func TestFileSendStalePart(t *testing.T) {
+	r, dir, path := startFileService(t, fileMsgType, 3*DefaultFileChunkSize)
+	defer os.RemoveAll(dir)
+	defer r.Stop()
+	part := filepath.Join(dir, "snapshot"+partSuffix)
+
+	// larger than the file
+	stale := make([]byte, 4*DefaultFileChunkSize)
+	rand.Read(stale)
+	if err := ioutil.WriteFile(part, stale, 0644); err != nil {
+		t.Fatal(err)
+	}
+	fs := NewFileSender(r.Addr().String(), fileMsgType)
+	if err := fs.Send(path, "snapshot"); err != nil {
+		t.Fatal(err)
+	}
+	compareFiles(t, path, filepath.Join(dir, "snapshot"))
+
+	// of the file's size and checksum, but other bytes
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crc, _ := fileChecksum(bytes.NewReader(data), int64(len(data)))
+	if err := ioutil.WriteFile(part, stale[:DefaultFileChunkSize], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(part+idSuffix, fileID(uint64(len(data)), crc), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(filepath.Join(dir, "snapshot"))
+	if err := fs.Send(path, "snapshot"); err != nil {
+		t.Fatal(err)
+	}
+	compareFiles(t, path, filepath.Join(dir, "snapshot"))
+}
+
+// Test types which do not require reply by default carry the requests,
+// and the connection is closed once the transfer is done
+func TestFileSendOneWayType(t *testing.T) {
+	const msgType = 20
+	r, dir, path := startFileService(t, msgType, 2*DefaultFileChunkSize)
+	defer os.RemoveAll(dir)
+	defer r.Stop()
+
+	fs := NewFileSender(r.Addr().String(), msgType)
+	if err := fs.Send(path, "snapshot"); err != nil {
+		t.Fatal(err)
+	}
+	compareFiles(t, path, filepath.Join(dir, "snapshot"))
+	if fs.s != nil {
+		t.Fatal("expect the connection to be closed")
+	}
+}
@@ -0,0 +1,103 @@
+package message
+
+import (
+	"context"
+	"math"
+
+	"github.com/coreos/go-log/log"
+)
+
+// Flow control keeps a fast sender from piling messages onto a slow
+// receiver over a session. The receiver answers the session preamble
+// with a frameCredit granting the sender its window, a message delivered
+// to the receiver takes a credit, and the receiver grants credits back
+// in frameCredit frames as Recv drains its queue. A sender waits for the
+// initial grant before it sends anything which takes a credit, and a
+// sender out of credits waits for more. An initial grant of 0 credits
+// means the receiver does not limit the sender.
+
+// SetWindow limits the messages a sender may have queued at the receiver
+// to n per connection in the session format, 0 for no limit. It must be
+// called before the receiver is started. Connections in the plain format
+// are not flow controlled: a request waits for its reply, but one-way
+// messages are only held back by the receiver's queue, see SetQueue.
+func (r *Receiver) SetWindow(n int) {
+	if n < 0 {
+		n = 0
+	}
+	r.window = uint32(n)
+}
+
+// grantWindow grants the sender the initial window, 0 for no limit.
+// It is written before the connection is shared with other writers.
+func grantWindow(e *MsgEncoder, window uint32) error {
+	return e.encodeFrame(frameCredit, window, NewEmptyMessage())
+}
+
+// release gives back the credit of a delivered message once the
+// receiver no longer holds it. Credits are granted in batches of half
+// the window.
+func (s *session) release() {
+	s.mu.Lock()
+	if s.window == 0 || s.err != nil {
+		s.mu.Unlock()
+		return
+	}
+	s.owed++
+	if s.owed < (s.window+1)/2 {
+		s.mu.Unlock()
+		return
+	}
+	n := s.owed
+	s.owed = 0
+	s.mu.Unlock()
+
+	// release runs on the receiver's goroutines, which must not wait
+	// for the connection
+	go func() {
+		if err := s.writeFrameAt(math.MaxInt8, frameCredit, n, NewEmptyMessage()); err != nil {
+			log.Warning("session.release() error: ", err)
+			s.close(err)
+		}
+	}()
+}
+
+// credit adds the credits granted by the receiver. The first grant
+// opens the session for messages which take a credit.
+func (s *session) credit(n uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.open {
+		s.open = true
+		s.unlimited = n == 0
+	}
+	s.granted += uint64(n)
+	close(s.grant)
+	s.grant = make(chan struct{})
+}
+
+// acquire takes a credit to send a message which is delivered to the
+// receiver, waiting for the receiver to grant one until ctx is done
+func (s *session) acquire(ctx context.Context) error {
+	for {
+		s.mu.Lock()
+		if err := s.err; err != nil {
+			s.mu.Unlock()
+			return err
+		}
+		if s.open && (s.unlimited || s.sent < s.granted) {
+			s.sent++
+			s.mu.Unlock()
+			return nil
+		}
+		grant := s.grant
+		s.mu.Unlock()
+
+		select {
+		case <-grant:
+		case <-s.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package message
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestFlowControl(t *testing.T) {
+	r := NewReceiver("127.0.0.1:0")
+	r.SetWindow(2)
+	if err := r.GoStart(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	sender, err := NewSender(r.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		msg := r.Recv()
+		msg.reply <- nil
+	}()
+	if _, err := sender.SendContext(context.Background(), NewRequest(1, nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := sender.SendContext(context.Background(), NewMessage(1, nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := sender.SendContext(ctx, NewMessage(1, nil)); err != context.DeadlineExceeded {
+		t.Fatal("expect the sender to run out of credits, got ", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := sender.SendContext(context.Background(), NewMessage(1, nil))
+		done <- err
+	}()
+	select {
+	case <-done:
+		t.Fatal("expect the sender to wait for credits")
+	case <-time.After(50 * time.Millisecond):
+	}
+	r.Recv()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expect the receiver to grant a credit")
+	}
+}
+
+// Test senders are not limited by receivers which grant no credits
+func TestFlowControlOff(t *testing.T) {
+	r := NewReceiver("127.0.0.1:0")
+	r.SetQueue(QueueConfig{Size: 100})
+	if err := r.GoStart(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	sender, err := NewSender(r.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		_, err := sender.SendContext(ctx, NewMessage(1, nil))
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Test the first messages of a session wait for the initial grant
+func TestFlowControlStart(t *testing.T) {
+	r := NewReceiver("127.0.0.1:0")
+	r.SetWindow(2)
+	if err := r.GoStart(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	sender, err := NewSender(r.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := sender.SendContext(context.Background(), NewMessage(1, nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := sender.SendContext(ctx, NewMessage(1, nil)); err != context.DeadlineExceeded {
+		t.Fatal("expect the window to limit the first messages, got ", err)
+	}
+}
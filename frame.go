@@ -0,0 +1,128 @@
+package message
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// A connection starts in the plain format: frames of msgType, size and
+// bytes, with at most one request waiting for its reply. A session
+// preamble switches it to the session format, where every frame also
+// carries a kind and a request id, so that requests and replies can
+// flow in both directions and out of order:
+//
+//	kind     uint8
+//	id       uint32
+//	flags    uint8   as in the extended format
+//	msgType  uint16
+//	size     uint32
+//	expires  int64   if flagExpiry is set
+//	priority int8    if flagPriority is set
+//	header   block, if flagHeader is set, see Header
+//	bytes    [size]byte
+//
+// The preamble looks like an extended frame with all flags set,
+// which no plain sender would send.
+const (
+	frameMsg     = iota // one-way message, id is 0
+	frameRequest        // request, replied with a frameReply of the same id
+	frameReply
+	frameHello // first frame between two replicas, id is the node ID
+
+	frameStreamRequest // request, replied with frameStreamReply frames of the same id
+	frameStreamReply
+	frameStreamEnd // ends the stream of replies of a frameStreamRequest
+
+	frameCancel // the sender gave up on the request of the same id
+
+	frameChunkStart // message whose bytes follow in frameChunk frames of the same id
+	frameChunk
+	frameChunkEnd   // all bytes of the chunked message are sent
+	frameChunkAbort // the sender failed to read the bytes of the chunked message
+
+	frameCredit // the receiver accepts id more messages, see SetWindow
+
+	sessionHeaderSize = 12
+)
+
+var (
+	sessionPreamble = []byte{0xff, 0xff, 0xff, 0xff, 0xff}
+
+	ErrBadFrame = errors.New("message: unexpected frame")
+)
+
+// isSessionPreamble consumes the session preamble if the stream starts with it
+func (md *MsgDecoder) isSessionPreamble() bool {
+	b, err := md.br.Peek(len(sessionPreamble))
+	if err != nil {
+		return false
+	}
+	for i := range b {
+		if b[i] != sessionPreamble[i] {
+			return false
+		}
+	}
+	md.br.Discard(len(b))
+	return true
+}
+
+func (me *MsgEncoder) writeSessionPreamble() error {
+	if _, err := me.bw.Write(sessionPreamble); err != nil {
+		return err
+	}
+	return me.bw.Flush()
+}
+
+func (me *MsgEncoder) encodeFrame(kind uint8, id uint32, m *Message) error {
+	flags := m.flags()
+	ext, err := m.marshalExt(flags)
+	if err != nil {
+		return err
+	}
+
+	var hdr [sessionHeaderSize]byte
+	hdr[0] = kind
+	binary.LittleEndian.PutUint32(hdr[1:], id)
+	hdr[5] = flags
+	binary.LittleEndian.PutUint16(hdr[6:], m.msgType)
+	binary.LittleEndian.PutUint32(hdr[8:], uint32(len(m.bytes)))
+
+	if _, err := me.bw.Write(hdr[:]); err != nil {
+		return err
+	}
+	if _, err := me.bw.Write(ext); err != nil {
+		return err
+	}
+	if _, err := me.bw.Write(m.bytes); err != nil {
+		return err
+	}
+	return me.bw.Flush()
+}
+
+func (md *MsgDecoder) decodeFrame(m *Message) (kind uint8, id uint32, err error) {
+	var hdr [sessionHeaderSize]byte
+	if _, err = io.ReadFull(md.br, hdr[:]); err != nil {
+		return
+	}
+	kind = hdr[0]
+	id = binary.LittleEndian.Uint32(hdr[1:])
+	flags := hdr[5]
+	m.requireReply = flags&flagRequireReply != 0
+	m.msgType = binary.LittleEndian.Uint16(hdr[6:])
+	if flags&^knownFlags != 0 {
+		err = ErrBadFrame
+		return
+	}
+
+	size := binary.LittleEndian.Uint32(hdr[8:])
+	if err = checkSize(m.msgType, int(size)); err != nil {
+		return
+	}
+	if err = md.readExt(&m.frameMeta, flags); err != nil {
+		return
+	}
+	m.bytes = make([]byte, size)
+	_, err = io.ReadFull(md.br, m.bytes)
+	return
+}
@@ -0,0 +1,117 @@
+package message
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+const (
+	maxHeaderSize = 64 * 1024 // largest header block accepted
+)
+
+var (
+	ErrHeaderTooLarge = errors.New("message: header exceeds 64KB")
+)
+
+// Header carries metadata along the payload of a message,
+// e.g. trace IDs, the sender's ID or auth tokens
+type Header map[string]string
+
+func (h Header) Get(key string) string { return h[key] }
+
+func (h Header) Set(key, value string) { h[key] = value }
+
+func (h Header) Del(key string) { delete(h, key) }
+
+// Header returns the header of the message, which is sent with it
+// in the extended frame format if it is not empty
+func (m *Message) Header() Header {
+	if m.header == nil {
+		m.header = make(Header)
+	}
+	return m.header
+}
+
+// Header returns the header of the message, see Message.Header
+func (m *PbMessage) Header() Header {
+	if m.header == nil {
+		m.header = make(Header)
+	}
+	return m.header
+}
+
+// The header block follows the frame header if flagHeader is set:
+//
+//	size    uint32
+//	entries [size]byte
+//
+// with entries sorted by key:
+//
+//	keyLen   uint16
+//	key      [keyLen]byte
+//	valueLen uint16
+//	value    [valueLen]byte
+func (h Header) marshal() ([]byte, error) {
+	size := h.size()
+	if size > maxHeaderSize {
+		return nil, ErrHeaderTooLarge
+	}
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	b := make([]byte, 4, 4+size)
+	binary.LittleEndian.PutUint32(b, uint32(size))
+	for _, k := range keys {
+		b = appendString(b, k)
+		b = appendString(b, h[k])
+	}
+	return b, nil
+}
+
+// size returns the size of the entries of the header block
+func (h Header) size() int {
+	size := 0
+	for k, v := range h {
+		size += 4 + len(k) + len(v)
+	}
+	return size
+}
+
+func appendString(b []byte, s string) []byte {
+	var n [2]byte
+	binary.LittleEndian.PutUint16(n[:], uint16(len(s)))
+	return append(append(b, n[:]...), s...)
+}
+
+// unmarshalHeader parses the entries of a header block
+func unmarshalHeader(b []byte) (Header, error) {
+	h := make(Header)
+	for len(b) > 0 {
+		k, rest, ok := readString(b)
+		if !ok {
+			return nil, ErrBadFrame
+		}
+		v, rest, ok := readString(rest)
+		if !ok {
+			return nil, ErrBadFrame
+		}
+		h[k] = v
+		b = rest
+	}
+	return h, nil
+}
+
+func readString(b []byte) (s string, rest []byte, ok bool) {
+	if len(b) < 2 {
+		return
+	}
+	n := 2 + int(binary.LittleEndian.Uint16(b))
+	if len(b) < n {
+		return
+	}
+	return string(b[2:n]), b[n:], true
+}
@@ -0,0 +1,108 @@
+package message
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-epaxos/message/example"
+)
+
+func TestHeaderEncoderAndDecoder(t *testing.T) {
+	register(MsgRequireReply+1, reflect.TypeOf(example.A{}))
+
+	msg := NewMessage(1, []byte("hello"))
+	msg.Header().Set("trace", "42")
+	msg.Header().Set("from", "replica 1")
+	pbMsg := NewPbMessage(MsgRequireReply+1, &example.A{Description: "hello"})
+	pbMsg.Header().Set("trace", "43")
+
+	buf := new(bytes.Buffer)
+	e := NewMsgEncoder(buf)
+	if err := e.Encode(msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.EncodePb(pbMsg); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewMsgDecoder(buf)
+	outMsg := NewEmptyMessage()
+	if err := d.Decode(outMsg); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(msg, outMsg) {
+		t.Fatal("Messages are not equal!")
+	}
+	outPbMsg := NewEmptyPbMessage()
+	if err := d.DecodePb(outPbMsg); err != nil {
+		t.Fatal(err)
+	}
+	if outPbMsg.Header().Get("trace") != "43" || !outPbMsg.RequireReply() {
+		t.Fatal("Messages are not equal!")
+	}
+
+	msg.Header().Set("token", strings.Repeat("x", maxHeaderSize))
+	if err := e.Encode(msg); err != ErrHeaderTooLarge {
+		t.Fatal("expect ErrHeaderTooLarge, got ", err)
+	}
+}
+
+func TestHeaderSendTo(t *testing.T) {
+	r := NewReceiver("127.0.0.1:0")
+	go func() {
+		msg := r.Recv()
+		reply := NewEmptyMessage()
+		reply.Header().Set("trace", msg.Header().Get("trace"))
+		msg.reply <- reply
+	}()
+
+	msg := NewMessage(MsgRequireReply+1, nil)
+	msg.Header().Set("trace", "42")
+	if reply := SendTo(r, msg); reply.Header().Get("trace") != "42" {
+		t.Fatal("header is lost")
+	}
+}
+
+// Test headers travel with requests and replies on both connection formats
+func TestHeaderSend(t *testing.T) {
+	r := NewReceiver("127.0.0.1:0")
+	if err := r.GoStart(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+	go func() {
+		for {
+			msg := r.Recv()
+			reply := NewMessage(0, msg.Bytes())
+			reply.Header().Set("trace", msg.Header().Get("trace"))
+			msg.reply <- reply
+		}
+	}()
+
+	sender, err := NewSender(r.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := NewMessage(MsgRequireReply+1, []byte("hello"))
+	msg.Header().Set("trace", "42")
+	reply, err := sender.Send(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply.Bytes()) != "hello" || reply.Header().Get("trace") != "42" {
+		t.Fatal("error recv!")
+	}
+
+	// switches the connection to the session format
+	msg.Header().Set("trace", "43")
+	reply, err = sender.SendContext(context.Background(), msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply.Bytes()) != "hello" || reply.Header().Get("trace") != "43" {
+		t.Fatal("error recv!")
+	}
+}
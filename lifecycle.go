@@ -0,0 +1,284 @@
+package message
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-log/log"
+)
+
+const (
+	shutdownPollInterval = 10 * time.Millisecond // of requests in flight
+	acceptRetryDelay     = 5 * time.Millisecond  // after a temporary Accept error
+)
+
+var (
+	ErrReceiverClosed = errors.New("message: receiver is closed")
+)
+
+// lifecycle tracks what a receiver closes or waits for when it stops:
+// its listeners, the connections it serves, the goroutines serving
+// them and the requests waiting for reply. A stopped receiver starts
+// again when it listens again.
+type lifecycle struct {
+	mu        sync.Mutex
+	ready     chan struct{} // closed once the receiver listens for connections
+	stopping  chan struct{} // closed once the receiver stops accepting
+	closed    chan struct{} // closed once its connections are closed
+	addr      net.Addr      // of the first stream listener
+	listeners []io.Closer
+	conns     map[io.Closer]struct{}
+	inflight  int
+	wg        sync.WaitGroup // accept loops and connection goroutines
+	onStop    func()         // wakes what waits for the receiver, may be nil
+}
+
+func newLifecycle() *lifecycle {
+	return &lifecycle{
+		ready:    make(chan struct{}),
+		stopping: make(chan struct{}),
+		closed:   make(chan struct{}),
+		conns:    make(map[io.Closer]struct{}),
+	}
+}
+
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// stopped reports whether the receiver stopped accepting
+func (lc *lifecycle) stopped() bool {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	return isClosed(lc.stopping)
+}
+
+// stoppingChan returns the channel closed once the receiver stops accepting
+func (lc *lifecycle) stoppingChan() <-chan struct{} {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	return lc.stopping
+}
+
+// readyChan returns the channel closed once the receiver listens
+func (lc *lifecycle) readyChan() <-chan struct{} {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	return lc.ready
+}
+
+// closedChan returns the channel closed once the connections
+// the receiver serves now are closed
+func (lc *lifecycle) closedChan() <-chan struct{} {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	return lc.closed
+}
+
+// listen registers a listener and the goroutine accepting from it,
+// which calls lc.wg.Done when it returns. The receiver is ready once
+// it has a stream listener. A stopped receiver is started again, once
+// Stop or Shutdown returned.
+func (lc *lifecycle) listen(ln io.Closer) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if isClosed(lc.stopping) {
+		lc.ready = make(chan struct{})
+		lc.stopping = make(chan struct{})
+		lc.closed = make(chan struct{})
+		lc.addr = nil
+	}
+	lc.listeners = append(lc.listeners, ln)
+	lc.wg.Add(1)
+	if l, ok := ln.(net.Listener); ok && lc.addr == nil {
+		lc.addr = l.Addr()
+		close(lc.ready)
+	}
+}
+
+// listening reports whether ln is still registered, it is not once
+// the receiver stopped
+func (lc *lifecycle) listening(ln io.Closer) bool {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	for _, l := range lc.listeners {
+		if l == ln {
+			return true
+		}
+	}
+	return false
+}
+
+// Addr returns the address of the stream listener, nil if none
+func (lc *lifecycle) Addr() net.Addr {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	return lc.addr
+}
+
+// accept accepts connections from ln, registered by listen, until the
+// receiver stops, and serves each on a goroutine of its own. It returns
+// nil once the receiver stops, or the first error which is not temporary.
+func (lc *lifecycle) accept(ln net.Listener, serve func(net.Conn)) error {
+	defer lc.wg.Done()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if !lc.listening(ln) {
+				return nil
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				// e.g. out of file descriptors
+				log.Warning("Accept() error: ", err)
+				time.Sleep(acceptRetryDelay)
+				continue
+			}
+			return err
+		}
+		if lc.track(conn) {
+			go func() {
+				defer lc.untrack(conn)
+				serve(conn)
+			}()
+		}
+	}
+}
+
+// track registers a connection and the goroutine serving it, which
+// calls untrack when it returns. If the receiver is stopped, c is
+// closed and track returns false.
+func (lc *lifecycle) track(c io.Closer) bool {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if isClosed(lc.stopping) {
+		c.Close()
+		return false
+	}
+	lc.conns[c] = struct{}{}
+	lc.wg.Add(1)
+	return true
+}
+
+// untrack closes a connection once it is served
+func (lc *lifecycle) untrack(c io.Closer) {
+	lc.mu.Lock()
+	delete(lc.conns, c)
+	lc.mu.Unlock()
+	c.Close()
+	lc.wg.Done()
+}
+
+// begin counts a request in flight until end is called,
+// lc may be nil for connections of no receiver
+func (lc *lifecycle) begin() {
+	if lc == nil {
+		return
+	}
+	lc.mu.Lock()
+	lc.inflight++
+	lc.mu.Unlock()
+}
+
+func (lc *lifecycle) end() {
+	if lc == nil {
+		return
+	}
+	lc.mu.Lock()
+	lc.inflight--
+	lc.mu.Unlock()
+}
+
+func (lc *lifecycle) idle() bool {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	return lc.inflight == 0
+}
+
+// stop closes the listeners
+func (lc *lifecycle) stop() error {
+	lc.mu.Lock()
+	if isClosed(lc.stopping) {
+		lc.mu.Unlock()
+		return nil
+	}
+	close(lc.stopping)
+	listeners := lc.listeners
+	lc.listeners = nil
+	onStop := lc.onStop
+	lc.mu.Unlock()
+
+	if onStop != nil {
+		onStop()
+	}
+	var err error
+	for _, ln := range listeners {
+		if e := ln.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// closeConns closes the connections being served
+func (lc *lifecycle) closeConns() {
+	lc.mu.Lock()
+	if isClosed(lc.closed) {
+		lc.mu.Unlock()
+		return
+	}
+	close(lc.closed)
+	conns := lc.conns
+	lc.conns = make(map[io.Closer]struct{})
+	lc.mu.Unlock()
+
+	for c := range conns {
+		c.Close()
+	}
+}
+
+// close stops the receiver without waiting for anything
+func (lc *lifecycle) close() error {
+	err := lc.stop()
+	lc.closeConns()
+	return err
+}
+
+// shutdown stops accepting, waits for the requests in flight to be
+// replied, closes the connections and waits for their goroutines,
+// until ctx is done
+func (lc *lifecycle) shutdown(ctx context.Context) error {
+	err := lc.stop()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for !lc.idle() {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			lc.closeConns()
+			return ctx.Err()
+		}
+	}
+	lc.closeConns()
+
+	done := make(chan struct{})
+	go func() {
+		lc.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,246 @@
+package message
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-epaxos/message/example"
+)
+
+func TestStopBeforeStart(t *testing.T) {
+	r := NewReceiver("127.0.0.1:0")
+	if err := r.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.GoStart(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+	if _, err := NewSender(r.Addr().String()); err != nil {
+		t.Fatal("expect a stopped receiver to start again, got ", err)
+	}
+}
+
+func TestStartError(t *testing.T) {
+	r := NewReceiver("127.0.0.1:0")
+	if err := r.GoStart(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	if err := NewReceiver(r.Addr().String()).GoStart(); err == nil {
+		t.Fatal("expect the address to be in use")
+	}
+	if err := NewPbReceiver(r.Addr().String()).Start(); err == nil {
+		t.Fatal("expect the address to be in use")
+	}
+}
+
+func TestReadyAddr(t *testing.T) {
+	r := NewReceiver("127.0.0.1:0")
+	if r.Addr() != nil {
+		t.Fatal("expect no address before the receiver listens")
+	}
+	go r.Start()
+	defer r.Stop()
+	select {
+	case <-r.Ready():
+	case <-time.After(time.Second):
+		t.Fatal("expect the receiver to be ready")
+	}
+	go echo(r)
+
+	sender, err := NewSender(r.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sender.Send(NewRequest(1, nil)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServeListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewPbReceiver(":0")
+	served := make(chan error, 1)
+	go func() { served <- r.Serve(ln) }()
+	<-r.Ready()
+	if r.Addr().String() != ln.Addr().String() {
+		t.Fatal("expect the address of the listener, got ", r.Addr())
+	}
+	go func() {
+		msg := r.Recv()
+		msg.reply <- NewEmptyPbMessage()
+	}()
+
+	sender, err := NewPbSender(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sender.Send(NewPbRequest(1, nil)); err != nil {
+		t.Fatal(err)
+	}
+	r.Stop()
+	if err := <-served; err != nil {
+		t.Fatal("expect Serve to return nil once stopped, got ", err)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	r := NewReceiver("127.0.0.1:0")
+	if err := r.GoStart(); err != nil {
+		t.Fatal(err)
+	}
+
+	sender, err := NewSender(r.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	replied := make(chan error, 1)
+	go func() {
+		_, err := sender.Send(NewRequest(1, nil))
+		replied <- err
+	}()
+	msg := r.Recv()
+
+	shut := make(chan error, 1)
+	go func() { shut <- r.Shutdown(context.Background()) }()
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-shut:
+		t.Fatal("expect Shutdown to wait for the request in flight")
+	default:
+	}
+	if _, err := NewSender(r.Addr().String()); err == nil {
+		t.Fatal("expect new connections to be refused")
+	}
+
+	msg.reply <- NewMessage(0, nil)
+	if err := <-replied; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-shut; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sender.Send(NewRequest(1, nil)); err == nil {
+		t.Fatal("expect the connection to be closed")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	r := NewReceiver("127.0.0.1:0")
+	if err := r.GoStart(); err != nil {
+		t.Fatal(err)
+	}
+
+	sender, err := NewSender(r.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	replied := make(chan error, 1)
+	go func() {
+		_, err := sender.SendContext(context.Background(), NewRequest(1, nil))
+		replied <- err
+	}()
+	// nobody replies
+	r.Recv()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := r.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatal("expect DeadlineExceeded, got ", err)
+	}
+	if err := <-replied; err == nil {
+		t.Fatal("expect the request to fail")
+	}
+}
+
+// Test Shutdown wakes the connections waiting for room in a full queue
+func TestShutdownQueueFull(t *testing.T) {
+	r := NewReceiver("127.0.0.1:0")
+	if err := r.GoStart(); err != nil {
+		t.Fatal(err)
+	}
+
+	sender, err := NewSender(r.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < chanBufSize+2; i++ {
+		if _, err := sender.Send(NewMessage(1, nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for r.QueueStats().Len < chanBufSize {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := r.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Test Shutdown wakes the PbReceiver connections waiting for room
+func TestPbShutdownQueueFull(t *testing.T) {
+	register(0, reflect.TypeOf(example.PreAccept{}))
+	r := NewPbReceiver("127.0.0.1:0")
+	if err := r.GoStart(); err != nil {
+		t.Fatal(err)
+	}
+
+	sender, err := NewPbSender(r.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < chanBufSize+2; i++ {
+		if _, err := sender.Send(NewPbMessage(0, NewPreAcceptSample())); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for len(r.ch) < chanBufSize {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := r.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSenderClose(t *testing.T) {
+	r := NewReceiver("127.0.0.1:0")
+	if err := r.GoStart(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	sender, err := NewSender(r.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	replied := make(chan error, 1)
+	go func() {
+		_, err := sender.SendContext(context.Background(), NewRequest(1, nil))
+		replied <- err
+	}()
+	r.Recv()
+
+	if err := sender.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-replied; err != ErrSessionClosed {
+		t.Fatal("expect ErrSessionClosed, got ", err)
+	}
+	if err := sender.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,305 @@
+package message
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-log/log"
+)
+
+const (
+	helloReject = 0
+	helloAccept = 1
+
+	// how long a replica whose dial was rejected waits for
+	// the connection dialed by the other side
+	peerWaitTimeout = time.Second
+)
+
+var (
+	ErrPeerUnavailable = errors.New("message: peer is not connected")
+
+	errHelloRejected = errors.New("message: peer keeps its own connection")
+)
+
+// PeerConn is a connection between two replicas,
+// both of them can send requests and replies over it.
+type PeerConn struct {
+	*session
+	id     NodeID // remote replica
+	dialer NodeID // replica which dialed the connection
+}
+
+// Send sends a message to the remote replica, it is safe for concurrent use
+func (c *PeerConn) Send(msg *Message) (*Message, error) {
+	return c.send(msg)
+}
+
+// SendContext is like Send, but cancels the request once ctx is done
+func (c *PeerConn) SendContext(ctx context.Context, msg *Message) (*Message, error) {
+	return c.sendContext(ctx, msg)
+}
+
+func (c *PeerConn) Close() {
+	c.close(nil)
+}
+
+// Mesh keeps a single connection between this replica and every other
+// one, instead of a Sender dialing out plus a connection accepted by the
+// Receiver. Connections are dialed on first Send, or accepted by the
+// Receiver from replicas which dialed first. When two replicas dial each
+// other at the same time, both keep the connection dialed by the replica
+// with the lower node ID. Messages from other replicas are delivered to
+// the Receiver like any other message.
+type Mesh struct {
+	id NodeID
+	r  *Receiver
+
+	mu      sync.Mutex
+	addrs   map[NodeID]string
+	conns   map[NodeID]*PeerConn
+	dialing map[NodeID]bool
+	changed chan struct{} // closed and replaced whenever conns or dialing change
+}
+
+// NewMesh creates the mesh of replica id, members maps node ID to the
+// address of its Receiver. r must be started to accept connections.
+func NewMesh(id NodeID, r *Receiver, members map[NodeID]string) *Mesh {
+	m := &Mesh{
+		id:      id,
+		r:       r,
+		addrs:   make(map[NodeID]string, len(members)),
+		conns:   make(map[NodeID]*PeerConn),
+		dialing: make(map[NodeID]bool),
+		changed: make(chan struct{}),
+	}
+	for nid, addr := range members {
+		if nid != id {
+			m.addrs[nid] = addr
+		}
+	}
+	r.mesh = m
+	return m
+}
+
+// Send sends a message to replica id, dialing it if needed
+func (m *Mesh) Send(id NodeID, msg *Message) (*Message, error) {
+	c, err := m.conn(id)
+	if err != nil {
+		return nil, err
+	}
+	return c.Send(msg)
+}
+
+// SendContext is like Send, but cancels the request once ctx is done
+func (m *Mesh) SendContext(ctx context.Context, id NodeID, msg *Message) (*Message, error) {
+	c, err := m.conn(id)
+	if err != nil {
+		return nil, err
+	}
+	return c.SendContext(ctx, msg)
+}
+
+// Close closes the connections to all replicas
+func (m *Mesh) Close() {
+	m.mu.Lock()
+	conns := make([]*PeerConn, 0, len(m.conns))
+	for _, c := range m.conns {
+		conns = append(conns, c)
+	}
+	m.mu.Unlock()
+
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+// notify wakes up everyone waiting for a connection, m.mu must be held
+func (m *Mesh) notify() {
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+func (m *Mesh) conn(id NodeID) (*PeerConn, error) {
+	deadline := time.Now().Add(peerWaitTimeout)
+
+	m.mu.Lock()
+	for {
+		if c := m.conns[id]; c != nil {
+			m.mu.Unlock()
+			return c, nil
+		}
+		if !m.dialing[id] {
+			break
+		}
+
+		// wait for a dial in progress
+		ch := m.changed
+		m.mu.Unlock()
+		select {
+		case <-ch:
+		case <-time.After(deadline.Sub(time.Now())):
+			return nil, ErrPeerUnavailable
+		}
+		m.mu.Lock()
+	}
+
+	addr, ok := m.addrs[id]
+	if !ok {
+		m.mu.Unlock()
+		return nil, ErrUnknownPeer
+	}
+	m.dialing[id] = true
+	m.mu.Unlock()
+
+	c, err := m.dial(id, addr)
+
+	m.mu.Lock()
+	delete(m.dialing, id)
+	m.notify()
+	if err == errHelloRejected {
+		// the other side keeps the connection it dialed, wait for it
+		for m.conns[id] == nil {
+			ch := m.changed
+			m.mu.Unlock()
+			select {
+			case <-ch:
+			case <-time.After(deadline.Sub(time.Now())):
+				return nil, ErrPeerUnavailable
+			}
+			m.mu.Lock()
+		}
+		c = m.conns[id]
+		m.mu.Unlock()
+		return c, nil
+	}
+	if err != nil {
+		m.mu.Unlock()
+		return nil, err
+	}
+
+	if old := m.conns[id]; old != nil && old.dialer < m.id {
+		// lost a race with the connection dialed by the other side
+		m.mu.Unlock()
+		c.Close()
+		return old, nil
+	}
+	old := m.conns[id]
+	m.conns[id] = c
+	m.notify()
+	m.mu.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+	go c.run()
+	return c, nil
+}
+
+// dial connects to replica id and introduces this replica
+func (m *Mesh) dial(id NodeID, addr string) (*PeerConn, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	d := NewMsgDecoder(conn)
+	e := NewMsgEncoder(conn)
+
+	if err := e.writeSessionPreamble(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := e.encodeFrame(frameHello, uint32(m.id), NewEmptyMessage()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// the other side grants its window before it answers the hello
+	grant := NewEmptyMessage()
+	kind, window, err := d.decodeFrame(grant)
+	if err == nil && kind != frameCredit {
+		err = ErrBadFrame
+	}
+	ack := NewEmptyMessage()
+	if err == nil {
+		kind, _, err = d.decodeFrame(ack)
+	}
+	if err == nil && kind != frameHello {
+		err = ErrBadFrame
+	}
+	if err == nil && ack.msgType != helloAccept {
+		err = errHelloRejected
+	}
+	if err == nil {
+		err = grantWindow(e, m.r.window)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c := m.newPeerConn(conn, d, e, id, m.id)
+	c.session.credit(window)
+	return c, nil
+}
+
+// accept answers the hello of replica id, which dialed this replica.
+// It returns nil if this replica keeps the connection it dialed itself.
+func (m *Mesh) accept(conn net.Conn, d *MsgDecoder, e *MsgEncoder, id NodeID) *PeerConn {
+	m.mu.Lock()
+	old := m.conns[id]
+	keepOwn := m.id < id && (old != nil && old.dialer == m.id || old == nil && m.dialing[id])
+	if keepOwn {
+		m.mu.Unlock()
+		e.encodeFrame(frameHello, uint32(m.id), NewMessage(helloReject, nil))
+		conn.Close()
+		return nil
+	}
+
+	// answer before the connection is visible to senders,
+	// so that the hello is the first frame the other side reads
+	if err := e.encodeFrame(frameHello, uint32(m.id), NewMessage(helloAccept, nil)); err != nil {
+		m.mu.Unlock()
+		log.Warning("Mesh.accept() error: ", err)
+		conn.Close()
+		return nil
+	}
+	c := m.newPeerConn(conn, d, e, id, id)
+	m.conns[id] = c
+	m.notify()
+	m.mu.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+	return c
+}
+
+func (m *Mesh) newPeerConn(conn net.Conn, d *MsgDecoder, e *MsgEncoder, id, dialer NodeID) *PeerConn {
+	c := &PeerConn{
+		id:     id,
+		dialer: dialer,
+	}
+	handle := &Conn{conn: conn}
+	in := m.r.q.newInbound(conn.RemoteAddr())
+	in.key = nodeKey(id)
+	c.session = newSession(conn, d, e, func(msg *Message) {
+		msg.conn = handle
+		m.r.deliver(in, msg)
+	})
+	c.session.window = m.r.window
+	c.session.track = m.r.lc
+	in.sess = c.session
+	handle.sess = c.session
+	c.onClose = func(*session) {
+		m.mu.Lock()
+		if m.conns[id] == c {
+			delete(m.conns, id)
+			m.notify()
+		}
+		m.mu.Unlock()
+	}
+	return c
+}
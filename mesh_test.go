@@ -0,0 +1,119 @@
+package message
+
+import (
+	"net"
+	"sync"
+	"testing"
+)
+
+// startMesh starts a replica for every id on a free port, the members
+// are known before the receivers serve
+func startMesh(t *testing.T, ids ...NodeID) map[NodeID]*Mesh {
+	lns := make(map[NodeID]net.Listener)
+	members := make(map[NodeID]string)
+	for _, id := range ids {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		lns[id] = ln
+		members[id] = ln.Addr().String()
+	}
+
+	meshes := make(map[NodeID]*Mesh)
+	for id, ln := range lns {
+		r := NewReceiver(members[id])
+		meshes[id] = NewMesh(id, r, members)
+		go r.Serve(ln)
+		<-r.Ready()
+		go func(id NodeID, r *Receiver) {
+			for {
+				msg := r.Recv()
+				if msg.RequireReply() {
+					msg.reply <- NewMessage(0, []byte{byte(id)})
+				}
+			}
+		}(id, r)
+	}
+	return meshes
+}
+
+func stopMesh(meshes map[NodeID]*Mesh) {
+	for _, m := range meshes {
+		m.Close()
+		m.r.Stop()
+	}
+}
+
+// checkSingleConn checks both replicas use the same TCP connection
+func checkSingleConn(t *testing.T, a, b *Mesh) {
+	a.mu.Lock()
+	ca := a.conns[b.id]
+	a.mu.Unlock()
+	b.mu.Lock()
+	cb := b.conns[a.id]
+	b.mu.Unlock()
+
+	if ca == nil || cb == nil {
+		t.Fatal("replicas are not connected")
+	}
+	if ca.conn.LocalAddr().String() != cb.conn.RemoteAddr().String() {
+		t.Fatal("replicas use two connections")
+	}
+}
+
+// Test both replicas send requests over the connection dialed by one of them
+func TestMeshSend(t *testing.T) {
+	meshes := startMesh(t, 1, 2)
+	defer stopMesh(meshes)
+
+	reply, err := meshes[1].Send(2, NewMessage(MsgRequireReply+1, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Bytes()[0] != 2 {
+		t.Fatal("error recv!")
+	}
+
+	reply, err = meshes[2].Send(1, NewMessage(MsgRequireReply+1, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Bytes()[0] != 1 {
+		t.Fatal("error recv!")
+	}
+	checkSingleConn(t, meshes[1], meshes[2])
+
+	if _, err := meshes[1].Send(3, NewMessage(0, nil)); err != ErrUnknownPeer {
+		t.Fatal("expect ErrUnknownPeer, got ", err)
+	}
+}
+
+// Test replicas dialing each other at the same time end up with one connection
+func TestMeshSimultaneousDial(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		meshes := startMesh(t, 1, 2)
+
+		var wg sync.WaitGroup
+		for _, pair := range [][2]NodeID{{1, 2}, {2, 1}} {
+			wg.Add(1)
+			go func(from, to NodeID) {
+				defer wg.Done()
+				reply, err := meshes[from].Send(to, NewMessage(MsgRequireReply+1, nil))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if reply.Bytes()[0] != byte(to) {
+					t.Error("error recv!")
+				}
+			}(pair[0], pair[1])
+		}
+		wg.Wait()
+		checkSingleConn(t, meshes[1], meshes[2])
+		if meshes[1].conns[2].dialer != 1 {
+			t.Fatal("the replica with the lower ID should win")
+		}
+		stopMesh(meshes)
+	}
+}
@@ -1,36 +1,88 @@
 package message
 
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
 const (
+	// MsgRequireReply is the largest type of the one-byte type space
+	// that does not require reply, larger ones up to 255 do. Wider types
+	// require reply only if created by NewRequest. A Descriptor registered
+	// for a type overrides the rule.
 	MsgRequireReply = 127
 )
 
-type Message struct {
-	// msgType 0-127 do not require reply
+// frameMeta is what the frame tells about a message besides its payload
+type frameMeta struct {
+	// msgType 0-127 do not require reply, unless created by NewRequest
 	// msgType 128-255 require reply
-	msgType uint8
-	bytes   []byte
-	reply   chan *Message
+	// msgType 256-65535 require reply if created by NewRequest
+	// unless the type is registered, see Register
+	msgType      uint16
+	requireReply bool
+	header       Header
+	expires      time.Time // zero if the message does not expire
+	priority     int       // sent only if set by SetPriority
+	prioritySet  bool
+}
+
+type Message struct {
+	frameMeta
+	bytes []byte
+	reply chan *Message
+	conn  *Conn // connection the message was received from
+
+	ctx    context.Context // canceled with the request, see Context
+	stream chan *Message   // set for requests which expect a stream of replies
+	body   io.Reader       // set for messages sent by SendReader
 }
 
-func NewMessage(msgType uint8, bytes []byte) *Message {
+func NewMessage(msgType uint16, bytes []byte) *Message {
 	m := &Message{
-		msgType: msgType,
-		bytes:   bytes,
+		frameMeta: frameMeta{
+			msgType:      msgType,
+			requireReply: requireReply(msgType),
+		},
+		bytes: bytes,
 	}
 
 	return m
 }
 
+// NewRequest creates a message which requires reply whatever its type
+func NewRequest(msgType uint16, bytes []byte) *Message {
+	m := NewMessage(msgType, bytes)
+	m.requireReply = true
+	return m
+}
+
 func NewEmptyMessage() *Message {
 	return NewMessage(0, nil)
 }
 
-func (m *Message) Type() uint8 { return m.msgType }
+func (m *Message) Type() uint16 { return m.msgType }
 
 func (m *Message) Bytes() []byte { return m.bytes }
 
+// Context returns the context of a received request, which is canceled
+// when the sender gives up on it or the connection breaks.
+// Handlers of long requests should stop once it is done.
+func (m *Message) Context() context.Context {
+	if m.ctx == nil {
+		return context.Background()
+	}
+	return m.ctx
+}
+
+// Conn returns the connection the message was received from,
+// or nil if it was sent by SendTo
+func (m *Message) Conn() *Conn { return m.conn }
+
 func (m *Message) AttachReplyChan() bool {
-	if m.msgType > MsgRequireReply {
+	if m.requireReply {
 		m.reply = make(chan *Message, 1)
 		return true
 	}
@@ -38,5 +90,77 @@ func (m *Message) AttachReplyChan() bool {
 }
 
 func (m *Message) RequireReply() bool {
-	return m.msgType > MsgRequireReply
+	return m.requireReply
+}
+
+// errorHeader is the header of the replies a receiver sends
+// instead of the handler's, e.g. for expired requests
+const errorHeader = "message-error"
+
+// replyErrors are the errors such replies are decoded to
+var replyErrors = []error{ErrExpired, ErrQueueFull, ErrRateLimited, ErrReceiverClosed}
+
+func errorReply(err error) *Message {
+	m := NewEmptyMessage()
+	m.Header().Set(errorHeader, err.Error())
+	return m
+}
+
+// Err returns the error the receiver replied with instead of handing the
+// request to a handler, or nil for a handler's reply. Senders return it
+// instead of the reply.
+func (m *frameMeta) Err() error {
+	s := m.header.Get(errorHeader)
+	if s == "" {
+		return nil
+	}
+	for _, err := range replyErrors {
+		if err.Error() == s {
+			return err
+		}
+	}
+	return replyError(s)
+}
+
+// replyError is an error replied by a receiver which this side
+// does not know
+type replyError string
+
+func (e replyError) Error() string { return string(e) }
+
+// replied reports whether err is the error of an error reply,
+// which leaves the connection usable
+func replied(err error) bool {
+	if _, ok := err.(replyError); ok {
+		return true
+	}
+	for _, e := range replyErrors {
+		if err == e {
+			return true
+		}
+	}
+	return false
+}
+
+// fail replies err to a message which is not handed to a handler
+func (m *Message) fail(err error) {
+	switch {
+	case m.stream != nil:
+		m.StreamReply(errorReply(err))
+		m.EndStream()
+	case m.reply != nil:
+		m.reply <- errorReply(err)
+	}
+	if m.body != nil {
+		// the connection stalls until the payload is read
+		go io.Copy(ioutil.Discard, m.body)
+	}
+}
+
+// replyOrErr returns the error of an error reply
+func replyOrErr(reply *Message) (*Message, error) {
+	if err := reply.Err(); err != nil {
+		return nil, err
+	}
+	return reply, nil
 }
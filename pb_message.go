@@ -1,36 +1,57 @@
 package message
 
 import (
+	"context"
+
 	"code.google.com/p/gogoprotobuf/proto"
 )
 
 type PbMessage struct {
-	// msgType 0-127 do not require reply
-	// msgType 128-255 require reply
-	msgType uint8
-	pb      proto.Message
-	reply   chan *PbMessage
+	frameMeta // requireReply is set by NewPbRequest instead of NewRequest
+	pb        proto.Message
+	reply     chan *PbMessage
+	ctx       context.Context // canceled with the request, see Context
 }
 
-func NewPbMessage(msgType uint8, pb proto.Message) *PbMessage {
+func NewPbMessage(msgType uint16, pb proto.Message) *PbMessage {
 	m := &PbMessage{
-		msgType: msgType,
-		pb:      pb,
+		frameMeta: frameMeta{
+			msgType:      msgType,
+			requireReply: requireReply(msgType),
+		},
+		pb: pb,
 	}
 
 	return m
 }
 
+// NewPbRequest creates a message which requires reply whatever its type
+func NewPbRequest(msgType uint16, pb proto.Message) *PbMessage {
+	m := NewPbMessage(msgType, pb)
+	m.requireReply = true
+	return m
+}
+
 func NewEmptyPbMessage() *PbMessage {
 	return NewPbMessage(0, nil)
 }
 
-func (m *PbMessage) Type() uint8 { return m.msgType }
+func (m *PbMessage) Type() uint16 { return m.msgType }
 
 func (m *PbMessage) Proto() proto.Message { return m.pb }
 
+// Context returns the context of a received request, which is canceled
+// when its connection breaks, e.g. once the sender gives up on it.
+// Handlers of long requests should stop once it is done.
+func (m *PbMessage) Context() context.Context {
+	if m.ctx == nil {
+		return context.Background()
+	}
+	return m.ctx
+}
+
 func (m *PbMessage) AttachReplyChan() bool {
-	if m.msgType > MsgRequireReply {
+	if m.requireReply {
 		m.reply = make(chan *PbMessage, 1)
 		return true
 	}
@@ -38,5 +59,14 @@ func (m *PbMessage) AttachReplyChan() bool {
 }
 
 func (m *PbMessage) RequireReply() bool {
-	return m.msgType > MsgRequireReply
+	return m.requireReply
+}
+
+// fail replies err to a message which is not handed to a handler
+func (m *PbMessage) fail(err error) {
+	if m.reply != nil {
+		reply := NewEmptyPbMessage()
+		reply.Header().Set(errorHeader, err.Error())
+		m.reply <- reply
+	}
 }
@@ -1,6 +1,7 @@
 package message
 
 import (
+	"context"
 	"io"
 	"net"
 	"time"
@@ -10,11 +11,13 @@ import (
 
 // Receiver struct
 type PbReceiver struct {
-	localAddr    *net.TCPAddr     // address
-	ln           *net.TCPListener // only TCP now
-	ch           chan *PbMessage  // message channel
-	stop         bool             // stop?
+	expired uint64 // expired messages dropped, first for atomic alignment
+
+	localAddr    *net.TCPAddr    // address
+	lc           *lifecycle      // listeners and connections, see Shutdown
+	ch           chan *PbMessage // message channel
 	replyTimeout time.Duration
+	limits       *limiter // nil if not limited, see SetLimits
 }
 
 // Constructor
@@ -26,6 +29,7 @@ func NewPbReceiver(addrStr string) *PbReceiver {
 		return nil
 	}
 	r.localAddr = addr
+	r.lc = newLifecycle()
 	r.ch = make(chan *PbMessage, chanBufSize)
 	// TODO: this should be configurable
 	r.replyTimeout = time.Millisecond * 50
@@ -33,24 +37,53 @@ func NewPbReceiver(addrStr string) *PbReceiver {
 }
 
 // Recv() will blocking until there is message
+// Expired messages are dropped, see SetExpiry
 func (r *PbReceiver) Recv() *PbMessage {
-	return <-r.ch
+	for {
+		m := <-r.ch
+		if !r.dropExpired(m) {
+			return m
+		}
+	}
 }
 
 // GoRecv() will return message if possible, or nil if no message
 func (r *PbReceiver) GoRecv() *PbMessage {
+	for {
+		select {
+		case m := <-r.ch:
+			if !r.dropExpired(m) {
+				return m
+			}
+		default:
+			return nil
+		}
+	}
+}
+
+// deliver queues a message received from the peer of key for Recv,
+// unless the receiver is stopped or the message is over the rate limits.
+// A message waiting for room fails once the receiver stops.
+func (r *PbReceiver) deliver(key limitKey, m *PbMessage) {
+	if r.lc.stopped() {
+		m.fail(ErrReceiverClosed)
+		return
+	}
+	if r.limits != nil && !r.limits.admit(key, m.msgType) {
+		m.fail(ErrRateLimited)
+		return
+	}
 	select {
-	case m := <-r.ch:
-		return m
-	default:
-		return nil
+	case r.ch <- m:
+	case <-r.lc.stoppingChan():
+		m.fail(ErrReceiverClosed)
 	}
 }
 
 // Send a message to a local receiver
 func PbSendTo(r *PbReceiver, m *PbMessage) *PbMessage {
 	attached := m.AttachReplyChan()
-	r.ch <- m
+	r.deliver(limitKey{}, m)
 	if attached {
 		reply := <-m.reply
 		return reply
@@ -58,50 +91,83 @@ func PbSendTo(r *PbReceiver, m *PbMessage) *PbMessage {
 	return nil
 }
 
-func (r *PbReceiver) GoStart() {
-	go r.Start()
+// GoStart serves the connections on a goroutine of its own,
+// see Receiver.GoStart
+func (r *PbReceiver) GoStart() error {
+	ln, err := r.Listen()
+	if err != nil {
+		return err
+	}
+	r.lc.listen(ln)
+	go func() {
+		if err := r.lc.accept(ln, r.handleConn); err != nil {
+			log.Error("Accept() error: ", err)
+		}
+	}()
+	return nil
 }
 
-// Stop the receiver
+// Stop the receiver at once, see Receiver.Stop
 func (r *PbReceiver) Stop() error {
-	r.stop = true
-	err := r.ln.Close()
+	return r.lc.close()
+}
+
+// Shutdown stops the receiver gracefully, see Receiver.Shutdown
+func (r *PbReceiver) Shutdown(ctx context.Context) error {
+	return r.lc.shutdown(ctx)
+}
+
+// Start listens and serves connections until the receiver is stopped,
+// see Receiver.Start
+func (r *PbReceiver) Start() error {
+	ln, err := r.Listen()
 	if err != nil {
 		return err
 	}
-	return nil
+	return r.Serve(ln)
 }
 
-// Start listen and receive messages
-func (r *PbReceiver) Start() {
+// Listen listens on the address of the receiver, see Receiver.Listen
+func (r *PbReceiver) Listen() (net.Listener, error) {
 	ln, err := net.ListenTCP("tcp", r.localAddr)
 	if err != nil {
-		log.Error("Listen() error: ", err)
-		return
-	}
-	r.ln = ln
-	for {
-		conn, err := r.ln.AcceptTCP()
-		if err != nil {
-			if r.stop {
-				return
-			}
-			log.Warning("Accept() error: ", err)
-			// TODO: is it a temp error?
-			// need to check!
-			continue
-		}
-		go r.handleConn(conn)
+		return nil, err
 	}
+	return ln, nil
+}
+
+// Serve serves the connections accepted from ln, see Receiver.Serve
+func (r *PbReceiver) Serve(ln net.Listener) error {
+	r.lc.listen(ln)
+	return r.lc.accept(ln, r.handleConn)
 }
 
+// Ready returns a channel closed once the receiver listens for connections
+func (r *PbReceiver) Ready() <-chan struct{} { return r.lc.readyChan() }
+
+// Addr returns the address the receiver listens on,
+// nil until it is ready
+func (r *PbReceiver) Addr() net.Addr { return r.lc.Addr() }
+
 // handleConn handles incoming connections
 // It decodes a message from TCP stream and sends it to channel
 func (r *PbReceiver) handleConn(conn net.Conn) {
 	d := NewMsgDecoder(conn)
 	e := NewMsgEncoder(conn)
+	key := hostKey(conn.RemoteAddr())
 
+	var peeked <-chan error // the connection is read while a request waits
 	for {
+		if peeked != nil {
+			if err := <-peeked; err != nil {
+				if err != io.EOF {
+					log.Warning("handleConn() error: ", err)
+				}
+				return
+			}
+			peeked = nil
+		}
+
 		// create an empty message with reply channel
 		msg := NewEmptyPbMessage()
 
@@ -116,22 +182,47 @@ func (r *PbReceiver) handleConn(conn net.Conn) {
 		}
 
 		attached := msg.AttachReplyChan()
+		var cancel context.CancelFunc
+		if attached {
+			r.lc.begin()
+			msg.ctx, cancel = context.WithCancel(context.Background())
+			peeked = watchConn(d, cancel)
+		}
 
 		// send received message for processing
-		r.ch <- msg
+		r.deliver(key, msg)
 
 		if attached {
 			// wait for reply
 			replyMsg := <-msg.reply
+			cancel()
 			if replyMsg != nil {
+				checkReply(msg.msgType, replyMsg.msgType)
 				if err := e.EncodePb(replyMsg); err != nil {
 					if err == io.EOF {
+						r.lc.end()
 						return
 					}
 					// TODO: handle error
-					log.Warning("handleConn() error: ", err)
+					log.Warning("handleConn() error: ", err, " replying to ", typeName(msg.msgType))
 				}
 			}
+			r.lc.end()
 		}
 	}
 }
+
+// watchConn reads the connection while a request waits for its reply,
+// the sender sends nothing else meanwhile. cancel is called once the
+// connection breaks, e.g. when the sender gives up on the request.
+func watchConn(d *MsgDecoder, cancel context.CancelFunc) <-chan error {
+	ch := make(chan error, 1)
+	go func() {
+		_, err := d.br.Peek(1)
+		if err != nil {
+			cancel()
+		}
+		ch <- err
+	}()
+	return ch
+}
@@ -1,14 +1,26 @@
 package message
 
 import (
+	"context"
+	"errors"
+	"math"
 	"net"
+	"time"
 )
 
+var (
+	ErrSenderClosed = errors.New("message: sender is closed")
+)
+
+// PbSender sends pbmessages over one connection. A connection broken
+// by a failed or canceled request is dialed again by the next Send.
 type PbSender struct {
+	mu         prioLock // one request at a time on the connection
 	remoteAddr *net.TCPAddr
-	conn       *net.TCPConn
+	conn       *net.TCPConn // nil once broken
 	encoder    *MsgEncoder
 	decoder    *MsgDecoder
+	closed     bool
 }
 
 func NewPbSender(raddrStr string) (*PbSender, error) {
@@ -17,25 +29,68 @@ func NewPbSender(raddrStr string) (*PbSender, error) {
 		return nil, err
 	}
 
-	conn, err := net.DialTCP("tcp", nil, raddr)
-	if err != nil {
+	s := &PbSender{remoteAddr: raddr}
+	if err := s.dial(); err != nil {
 		return nil, err
 	}
+	return s, nil
+}
 
-	return &PbSender{
-		remoteAddr: raddr,
-		conn:       conn,
-		encoder:    NewMsgEncoder(conn),
-		decoder:    NewMsgDecoder(conn),
-	}, nil
+// dial connects to the remote address, s.mu must be held
+func (s *PbSender) dial() error {
+	conn, err := net.DialTCP("tcp", nil, s.remoteAddr)
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	s.encoder = NewMsgEncoder(conn)
+	s.decoder = NewMsgDecoder(conn)
+	return nil
 }
 
+// Send sends a message and waits for its reply if it requires one,
+// no longer than the Timeout registered for its type
 func (s *PbSender) Send(msg *PbMessage) (*PbMessage, error) {
+	return s.SendContext(context.Background(), msg)
+}
+
+// SendContext is like Send, but gives up waiting for the reply once ctx
+// is done. The plain format can not tell the receiver which request to
+// cancel, so the connection is closed, which cancels the handler's
+// context, see PbMessage.Context. The next Send dials again.
+func (s *PbSender) SendContext(ctx context.Context, msg *PbMessage) (*PbMessage, error) {
+	s.mu.Lock(msg.Priority())
+	defer s.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if s.closed {
+		return nil, ErrSenderClosed
+	}
+	if s.conn == nil {
+		if err := s.dial(); err != nil {
+			return nil, err
+		}
+	}
+
+	if d := Lookup(msg.msgType); d != nil && d.Timeout > 0 && msg.RequireReply() && s.conn != nil {
+		// the connection is closed on timeout, see Sender.Send
+		s.conn.SetDeadline(time.Now().Add(d.Timeout))
+		defer func() {
+			if s.conn != nil {
+				s.conn.SetDeadline(time.Time{})
+			}
+		}()
+	}
+
 	err := s.encoder.EncodePb(msg)
 	// TODO: handle recoverable error...
+	if notWritten(err) {
+		return nil, err
+	}
 	if err != nil {
-		s.conn.Close()
-		s.conn = nil
+		s.closeConn()
 		return nil, err
 	}
 
@@ -43,16 +98,54 @@ func (s *PbSender) Send(msg *PbMessage) (*PbMessage, error) {
 		return nil, nil
 	}
 
+	if ctx.Done() != nil && s.conn != nil {
+		done := make(chan struct{})
+		defer close(done)
+		go func(conn net.Conn) {
+			select {
+			case <-ctx.Done():
+				conn.Close()
+			case <-done:
+			}
+		}(s.conn)
+	}
+
 	reply := NewEmptyPbMessage()
 	err = s.decoder.DecodePb(reply)
 	if err != nil {
-		s.conn.Close()
-		s.conn = nil
+		s.closeConn()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	if err := reply.Err(); err != nil {
 		return nil, err
 	}
 	return reply, nil
 }
 
+// Close closes the connection, once the request in flight is done.
+// Later sends fail with ErrSenderClosed.
+func (s *PbSender) Close() error {
+	s.mu.Lock(math.MaxInt8)
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+func (s *PbSender) closeConn() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
 func (s *PbSender) GoSend() {
 
 }
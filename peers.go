@@ -0,0 +1,146 @@
+package message
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+// NodeID identifies a replica
+type NodeID int32
+
+var (
+	ErrUnknownPeer = errors.New("message: unknown peer")
+)
+
+// Peers addresses the replicas of a cluster by node ID.
+// Connections are dialed on the first Send to a peer and dialed again
+// on the next Send after they break. Peers is safe for concurrent use,
+// requests to the same peer are sent one at a time.
+type Peers struct {
+	mu    sync.RWMutex
+	peers map[NodeID]*peer
+}
+
+type peer struct {
+	addr    string
+	mu      sync.Mutex // one request at a time on the connection
+	sender  *PbSender
+	removed bool
+}
+
+// NewPeers creates a peer manager with the given membership list,
+// which maps node ID to address
+func NewPeers(members map[NodeID]string) *Peers {
+	p := &Peers{
+		peers: make(map[NodeID]*peer, len(members)),
+	}
+	for id, addr := range members {
+		p.peers[id] = &peer{addr: addr}
+	}
+	return p
+}
+
+// Add adds a peer, or changes the address of an existing one
+func (p *Peers) Add(id NodeID, addr string) {
+	p.mu.Lock()
+	old := p.peers[id]
+	p.peers[id] = &peer{addr: addr}
+	p.mu.Unlock()
+
+	if old != nil {
+		old.close()
+	}
+}
+
+// Remove removes a peer and closes its connection
+func (p *Peers) Remove(id NodeID) {
+	p.mu.Lock()
+	old := p.peers[id]
+	delete(p.peers, id)
+	p.mu.Unlock()
+
+	if old != nil {
+		old.close()
+	}
+}
+
+// Addr returns the address of a peer
+func (p *Peers) Addr(id NodeID) (string, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	pr, ok := p.peers[id]
+	if !ok {
+		return "", false
+	}
+	return pr.addr, true
+}
+
+// IDs returns the sorted node IDs of all peers
+func (p *Peers) IDs() []NodeID {
+	p.mu.RLock()
+	ids := make([]NodeID, 0, len(p.peers))
+	for id := range p.peers {
+		ids = append(ids, id)
+	}
+	p.mu.RUnlock()
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// Send sends a message to the peer with the given node ID, dialing it
+// if it is not connected. A message of an idempotent type is sent once
+// more if the connection was broken, but not if the peer replied an
+// error, e.g. ErrRateLimited.
+func (p *Peers) Send(id NodeID, msg *PbMessage) (*PbMessage, error) {
+	p.mu.RLock()
+	pr, ok := p.peers[id]
+	p.mu.RUnlock()
+	if !ok {
+		return nil, ErrUnknownPeer
+	}
+	reply, err := pr.send(msg)
+	if broken(err) && err != ErrUnknownPeer {
+		if d := Lookup(msg.msgType); d != nil && d.Idempotent {
+			// the first send dropped the broken connection
+			return pr.send(msg)
+		}
+	}
+	return reply, err
+}
+
+func (pr *peer) send(msg *PbMessage) (*PbMessage, error) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	if pr.removed {
+		return nil, ErrUnknownPeer
+	}
+	if pr.sender == nil {
+		s, err := NewPbSender(pr.addr)
+		if err != nil {
+			return nil, err
+		}
+		pr.sender = s
+	}
+
+	reply, err := pr.sender.Send(msg)
+	if broken(err) {
+		// redial on next send
+		pr.sender.Close()
+		pr.sender = nil
+	}
+	return reply, err
+}
+
+// close waits for the request in flight and closes the connection
+func (pr *peer) close() {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	pr.removed = true
+	if pr.sender != nil {
+		pr.sender.Close()
+		pr.sender = nil
+	}
+}
@@ -0,0 +1,111 @@
+package message
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/go-epaxos/message/example"
+)
+
+func TestPeersSend(t *testing.T) {
+	register(MsgRequireReply+1, reflect.TypeOf(example.PreAccept{}))
+	r := NewPbReceiver("127.0.0.1:0")
+	if err := r.GoStart(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+	go pbEcho(r)
+
+	p := NewPeers(map[NodeID]string{1: r.Addr().String()})
+	msg := NewPbMessage(MsgRequireReply+1, NewPreAcceptSample())
+
+	reply, err := p.Send(1, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareMsg(msg, reply, t)
+
+	if _, err := p.Send(2, msg); err != ErrUnknownPeer {
+		t.Fatal("expect ErrUnknownPeer, got ", err)
+	}
+
+	// peers can be added and removed at runtime
+	p.Add(2, r.Addr().String())
+	if _, err := p.Send(2, msg); err != nil {
+		t.Fatal(err)
+	}
+	p.Remove(1)
+	if _, err := p.Send(1, msg); err != ErrUnknownPeer {
+		t.Fatal("expect ErrUnknownPeer, got ", err)
+	}
+	if ids := p.IDs(); !reflect.DeepEqual(ids, []NodeID{2}) {
+		t.Fatal("unexpected IDs ", ids)
+	}
+}
+
+// Test a broken connection is dialed again on next Send
+func TestPeersReconnect(t *testing.T) {
+	register(MsgRequireReply+1, reflect.TypeOf(example.PreAccept{}))
+	r := NewPbReceiver("127.0.0.1:0")
+	if err := r.GoStart(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+	go pbEcho(r)
+
+	p := NewPeers(map[NodeID]string{1: r.Addr().String()})
+	msg := NewPbMessage(MsgRequireReply+1, NewPreAcceptSample())
+	if _, err := p.Send(1, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	p.peers[1].sender.conn.Close()
+	if _, err := p.Send(1, msg); err == nil {
+		t.Fatal("send over a closed connection should fail")
+	}
+	if _, err := p.Send(1, msg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Test an error reply neither drops the connection nor resends the message
+func TestPeersErrorReply(t *testing.T) {
+	Register(2013, Descriptor{Name: "PeersRead", RequireReply: true, Idempotent: true})
+	register(2013, reflect.TypeOf(example.PreAccept{}))
+	r := NewPbReceiver("127.0.0.1:0")
+	r.SetLimits(RateLimits{Peer: Limit{Rate: 1, Burst: 1, Action: LimitReject}})
+	if err := r.GoStart(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+	go pbEcho(r)
+
+	p := NewPeers(map[NodeID]string{1: r.Addr().String()})
+	defer p.Remove(1)
+	msg := NewPbMessage(2013, NewPreAcceptSample())
+	if _, err := p.Send(1, msg); err != nil {
+		t.Fatal(err)
+	}
+	s := p.peers[1].sender
+	for i := 0; i < 4; i++ {
+		if _, err := p.Send(1, msg); err != ErrRateLimited {
+			t.Fatal("expect ErrRateLimited, got ", err)
+		}
+	}
+	if p.peers[1].sender != s {
+		t.Fatal("expect the connection to be kept")
+	}
+	if n := r.RateLimitedCount(); n != 4 {
+		t.Fatal("expect every message to be sent once, rejected ", n)
+	}
+}
+
+// pbEcho replies to every request with the request itself
+func pbEcho(r *PbReceiver) {
+	for {
+		msg := r.Recv()
+		if msg.RequireReply() {
+			msg.reply <- NewPbMessage(msg.Type(), msg.Proto())
+		}
+	}
+}
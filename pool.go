@@ -0,0 +1,144 @@
+package message
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+var (
+	ErrPoolClosed = errors.New("message: pool is closed")
+)
+
+// Pool keeps up to size connections to one remote address.
+// Requests are handed to idle connections in turn, connections are
+// dialed on demand and evicted once they break.
+type Pool struct {
+	remoteAddr *net.TCPAddr
+	size       int
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	idle   []*Sender // FIFO, so that load spreads over all connections
+	open   int       // idle + in use + being dialed
+	inUse  int
+	closed bool
+}
+
+type PoolStats struct {
+	Size  int // open connections
+	Idle  int
+	InUse int
+}
+
+func NewPool(raddrStr string, size int) (*Pool, error) {
+	raddr, err := net.ResolveTCPAddr("tcp", raddrStr)
+	if err != nil {
+		return nil, err
+	}
+	if size < 1 {
+		size = 1
+	}
+
+	p := &Pool{
+		remoteAddr: raddr,
+		size:       size,
+	}
+	p.cond = sync.NewCond(&p.mu)
+	return p, nil
+}
+
+// Send sends a message over an idle connection, waiting for one
+// if all size connections are in use. A message of an idempotent
+// type is sent once more on another connection if the first one breaks,
+// but not if the receiver replied an error, e.g. ErrQueueFull.
+func (p *Pool) Send(msg *Message) (*Message, error) {
+	reply, err := p.send(msg)
+	if broken(err) && err != ErrPoolClosed {
+		if d := Lookup(msg.msgType); d != nil && d.Idempotent {
+			return p.send(msg)
+		}
+	}
+	return reply, err
+}
+
+func (p *Pool) send(msg *Message) (*Message, error) {
+	s, err := p.get()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := s.Send(msg)
+	p.put(s, err)
+	return reply, err
+}
+
+func (p *Pool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return PoolStats{
+		Size:  p.open,
+		Idle:  len(p.idle),
+		InUse: p.inUse,
+	}
+}
+
+// Close closes the idle connections, connections in use
+// are closed when their request is done.
+func (p *Pool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for _, s := range p.idle {
+		s.Close()
+	}
+	p.open -= len(p.idle)
+	p.idle = nil
+	p.cond.Broadcast()
+}
+
+func (p *Pool) get() (*Sender, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for {
+		if p.closed {
+			return nil, ErrPoolClosed
+		}
+		if len(p.idle) > 0 {
+			s := p.idle[0]
+			p.idle = p.idle[1:]
+			p.inUse++
+			return s, nil
+		}
+		if p.open < p.size {
+			break
+		}
+		p.cond.Wait()
+	}
+
+	// dial without holding the lock
+	p.open++
+	p.mu.Unlock()
+	s, err := NewSender(p.remoteAddr.String())
+	p.mu.Lock()
+	if err != nil {
+		p.open--
+		p.cond.Signal()
+		return nil, err
+	}
+	p.inUse++
+	return s, nil
+}
+
+// put returns s to the idle list, or evicts it if the request broke it
+func (p *Pool) put(s *Sender, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.inUse--
+	if broken(err) || s.conn == nil || p.closed {
+		s.Close()
+		p.open--
+	} else {
+		p.idle = append(p.idle, s)
+	}
+	p.cond.Signal()
+}
@@ -0,0 +1,114 @@
+package message
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestPoolSend(t *testing.T) {
+	r := NewReceiver("127.0.0.1:0")
+	if err := r.GoStart(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+	go echo(r)
+
+	p, err := NewPool(r.Addr().String(), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				reply, err := p.Send(NewMessage(MsgRequireReply+1, []byte("hello")))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if string(reply.Bytes()) != "hello" {
+					t.Error("error recv!")
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	stats := p.Stats()
+	if stats.Size != 3 || stats.Idle != 3 || stats.InUse != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+// Test a broken connection is evicted and replaced
+func TestPoolEvict(t *testing.T) {
+	r := NewReceiver("127.0.0.1:0")
+	if err := r.GoStart(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+	go echo(r)
+
+	p, err := NewPool(r.Addr().String(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	msg := NewMessage(MsgRequireReply+1, []byte("hello"))
+	if _, err := p.Send(msg); err != nil {
+		t.Fatal(err)
+	}
+	p.idle[0].conn.Close()
+
+	if _, err := p.Send(msg); err == nil {
+		t.Fatal("send over a closed connection should fail")
+	}
+	if stats := p.Stats(); stats.Size != 0 {
+		t.Fatalf("broken connection is not evicted %+v", stats)
+	}
+	if _, err := p.Send(msg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Test an error reply neither evicts the connection nor resends the message
+func TestPoolErrorReply(t *testing.T) {
+	Register(2012, Descriptor{Name: "PoolRead", RequireReply: true, Idempotent: true})
+
+	r := NewReceiver("127.0.0.1:0")
+	r.SetQueue(QueueConfig{Size: 1, Policy: QueueReject})
+	if err := r.GoStart(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+	fillQueue(r, "1")
+
+	p, err := NewPool(r.Addr().String(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	if _, err := p.Send(NewMessage(2012, nil)); err != ErrQueueFull {
+		t.Fatal("expect ErrQueueFull, got ", err)
+	}
+	if stats := p.Stats(); stats.Size != 1 || stats.Idle != 1 {
+		t.Fatalf("connection is evicted %+v", stats)
+	}
+	s := p.idle[0]
+	if _, err := p.Send(NewMessage(2012, nil)); err != ErrQueueFull {
+		t.Fatal("expect ErrQueueFull, got ", err)
+	}
+	if p.idle[0] != s {
+		t.Fatal("expect the connection to be kept")
+	}
+	if n := r.QueueStats().Rejected; n != 2 {
+		t.Fatal("expect every message to be sent once, rejected ", n)
+	}
+}
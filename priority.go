@@ -0,0 +1,80 @@
+package message
+
+import (
+	"math"
+	"sync"
+)
+
+// SetPriority overrides the Priority registered for the message's type,
+// larger is more urgent. Senders write, and receivers deliver, queued
+// messages of higher priority first. p is clamped to [-128, 127].
+func (m *frameMeta) SetPriority(p int) {
+	switch {
+	case p > math.MaxInt8:
+		p = math.MaxInt8
+	case p < math.MinInt8:
+		p = math.MinInt8
+	}
+	m.priority, m.prioritySet = p, true
+}
+
+// Priority returns the priority set by SetPriority,
+// else the one registered for the message's type
+func (m *frameMeta) Priority() int {
+	if m.prioritySet {
+		return m.priority
+	}
+	if d := Lookup(m.msgType); d != nil {
+		return d.Priority
+	}
+	return 0
+}
+
+// prioLock is a mutex which, when unlocked, hands the lock to the waiter
+// of highest priority, first come first served among equals. It is the
+// write queue of a connection: a heartbeat waits for the frame being
+// written, not for every bulk frame queued before it.
+type prioLock struct {
+	mu      sync.Mutex
+	locked  bool
+	waiters []prioWaiter // by priority, highest first
+}
+
+type prioWaiter struct {
+	prio int
+	ch   chan struct{}
+}
+
+func (l *prioLock) Lock(prio int) {
+	l.mu.Lock()
+	if !l.locked {
+		l.locked = true
+		l.mu.Unlock()
+		return
+	}
+	i := len(l.waiters)
+	for i > 0 && l.waiters[i-1].prio < prio {
+		i--
+	}
+	w := prioWaiter{prio, make(chan struct{})}
+	l.waiters = append(l.waiters, prioWaiter{})
+	copy(l.waiters[i+1:], l.waiters[i:])
+	l.waiters[i] = w
+	l.mu.Unlock()
+
+	<-w.ch
+}
+
+func (l *prioLock) Unlock() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.waiters) == 0 {
+		l.locked = false
+		return
+	}
+	// the lock passes to the waiter without being released
+	w := l.waiters[0]
+	copy(l.waiters, l.waiters[1:])
+	l.waiters = l.waiters[:len(l.waiters)-1]
+	close(w.ch)
+}
@@ -0,0 +1,102 @@
+package message
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+func sendAt(r *Receiver, prio int, payload string) {
+	msg := NewMessage(1, []byte(payload))
+	msg.SetPriority(prio)
+	SendTo(r, msg)
+}
+
+func TestPriorityQueue(t *testing.T) {
+	Register(2010, Descriptor{Name: "Heartbeat", Priority: 10})
+
+	r := NewReceiver("127.0.0.1:0")
+	sendAt(r, 0, "1")
+	sendAt(r, -1, "2")
+	SendTo(r, NewMessage(2010, []byte("3")))
+	sendAt(r, 0, "4")
+	expectRecv(t, r, "3", "1", "4", "2")
+}
+
+func TestPriorityDropOldest(t *testing.T) {
+	r := NewReceiver("127.0.0.1:0")
+	r.SetQueue(QueueConfig{Size: 2, Policy: QueueDropOldest})
+
+	sendAt(r, 1, "1")
+	sendAt(r, 0, "2")
+	sendAt(r, 1, "3") // drops 2
+	sendAt(r, 0, "4") // dropped itself
+	expectRecv(t, r, "1", "3")
+	if r.QueueStats().Dropped != 2 {
+		t.Fatal("expect 2 dropped messages")
+	}
+}
+
+func TestPriorityFrame(t *testing.T) {
+	buf := new(bytes.Buffer)
+	msg := NewMessage(1, []byte("hello"))
+	msg.SetPriority(1000)
+	if err := NewMsgEncoder(buf).Encode(msg); err != nil {
+		t.Fatal(err)
+	}
+	msg = NewEmptyMessage()
+	if err := NewMsgDecoder(buf).Decode(msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Priority() != 127 || string(msg.Bytes()) != "hello" {
+		t.Fatal("unexpected message of priority ", msg.Priority())
+	}
+}
+
+func TestPrioLock(t *testing.T) {
+	var l prioLock
+	l.Lock(0)
+
+	order := make(chan int, 3)
+	for _, prio := range []int{0, 1, 5} {
+		go func(prio int) {
+			l.Lock(prio)
+			order <- prio
+			l.Unlock()
+		}(prio)
+		time.Sleep(10 * time.Millisecond)
+	}
+	l.Unlock()
+	for _, expect := range []int{5, 1, 0} {
+		if prio := <-order; prio != expect {
+			t.Fatal("expect priority ", expect, " got ", prio)
+		}
+	}
+}
+
+func TestPrioritySession(t *testing.T) {
+	r := NewReceiver("127.0.0.1:0")
+	if err := r.GoStart(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+	go func() {
+		msg := r.Recv()
+		msg.reply <- NewMessage(0, []byte{byte(msg.Priority())})
+	}()
+
+	sender, err := NewSender(r.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := NewRequest(1, nil)
+	msg.SetPriority(3)
+	reply, err := sender.SendContext(context.Background(), msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Bytes()[0] != 3 {
+		t.Fatal("priority is not sent")
+	}
+}
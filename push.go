@@ -0,0 +1,75 @@
+package message
+
+import (
+	"errors"
+	"net"
+
+	"github.com/coreos/go-log/log"
+)
+
+var (
+	ErrPushUnsupported = errors.New("message: connection does not accept pushed messages")
+)
+
+// Conn is a connection accepted by a Receiver. It is exposed on every
+// received message, so that the server can push messages to the client
+// later, e.g. commit notifications.
+type Conn struct {
+	conn net.Conn
+	sess *session // nil for connections in the plain format
+}
+
+func (c *Conn) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
+
+// Push sends a message to the client without waiting for any reply.
+// Only clients which called Sender.OnPush accept pushed messages.
+func (c *Conn) Push(msg *Message) error {
+	if c.sess == nil {
+		return ErrPushUnsupported
+	}
+	return c.sess.writeFrame(frameMsg, 0, msg)
+}
+
+// OnPush switches the connection to the session format, in which the
+// receiver can push messages at any time, and calls fn for every pushed
+// message. fn runs on the goroutine reading the connection, so replies
+// are delayed while it runs. OnPush must not be called while a request
+// sent by Send waits for its reply.
+func (s *Sender) OnPush(fn func(*Message)) error {
+	s.mu.Lock(0)
+	defer s.mu.Unlock()
+	return s.startSession(fn)
+}
+
+// startSession switches the connection to the session format.
+// s.mu must be held.
+func (s *Sender) startSession(fn func(*Message)) error {
+	if s.conn == nil {
+		return ErrSessionClosed
+	}
+	if err := s.encoder.writeSessionPreamble(); err != nil {
+		s.closeConn()
+		return err
+	}
+
+	s.sess = newSession(s.conn, s.decoder, s.encoder, fn)
+	go s.sess.run()
+	return nil
+}
+
+// session returns the sender's session, switching the connection to
+// the session format first if needed. Pushed messages are dropped
+// unless OnPush was called.
+func (s *Sender) session() (*session, error) {
+	s.mu.Lock(0)
+	defer s.mu.Unlock()
+	if s.sess == nil {
+		err := s.startSession(func(msg *Message) {
+			log.Warning("Sender drops pushed message of type ", typeName(msg.msgType))
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s.sess, nil
+}
@@ -0,0 +1,72 @@
+package message
+
+import (
+	"testing"
+	"time"
+)
+
+// Test the receiver pushes a message to a client after replying to it
+func TestPush(t *testing.T) {
+	r := NewReceiver("127.0.0.1:0")
+	if err := r.GoStart(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	sender, err := NewSender(r.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pushed := make(chan *Message, 1)
+	if err := sender.OnPush(func(msg *Message) { pushed <- msg }); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		msg := r.Recv()
+		msg.reply <- NewMessage(0, []byte("a reply"))
+		time.Sleep(10 * time.Millisecond)
+		if err := msg.Conn().Push(NewMessage(1, []byte("committed"))); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	reply, err := sender.Send(NewMessage(MsgRequireReply+1, []byte("a send")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply.Bytes()) != "a reply" {
+		t.Fatal("error recv!")
+	}
+
+	select {
+	case msg := <-pushed:
+		if msg.Type() != 1 || string(msg.Bytes()) != "committed" {
+			t.Fatal("error push!")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("pushed message is not delivered")
+	}
+}
+
+// Test plain connections reject pushes
+func TestPushUnsupported(t *testing.T) {
+	r := NewReceiver("127.0.0.1:0")
+	if err := r.GoStart(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	sender, err := NewSender(r.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sender.Send(NewMessage(0, nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := r.Recv()
+	if err := msg.Conn().Push(NewMessage(0, nil)); err != ErrPushUnsupported {
+		t.Fatal("expect ErrPushUnsupported, got ", err)
+	}
+}
@@ -0,0 +1,397 @@
+package message
+
+import (
+	"errors"
+	"math"
+	"net"
+	"sync"
+
+	"github.com/coreos/go-log/log"
+)
+
+// QueuePolicy tells a Receiver what to do with a message
+// that arrives while its queue is full
+type QueuePolicy int
+
+const (
+	// QueueBlock stops reading the connection until there is room,
+	// the message fails with ErrReceiverClosed if the receiver stops first
+	QueueBlock QueuePolicy = iota
+	// QueueDropNewest drops the arriving message. A dropped message
+	// which requires reply is replied ErrQueueFull, like QueueReject.
+	QueueDropNewest
+	// QueueDropOldest drops the oldest queued message to make room,
+	// replying ErrQueueFull if it requires reply
+	QueueDropOldest
+	// QueueReject replies ErrQueueFull to the arriving message
+	// if it requires reply, and drops it otherwise
+	QueueReject
+)
+
+var (
+	ErrQueueFull = errors.New("message: receiver queue is full")
+)
+
+// QueueConfig configures the queues of messages a Receiver holds until
+// they are received by Recv. Every connection has its own queue, so that
+// connections take turns, and ConnSize or ConnMaxBytes keep a chatty
+// peer from filling more than its own. Messages sent by SendTo or over
+// UDP share one queue.
+type QueueConfig struct {
+	Size     int // messages queued across all buffered messages, chanBufSize if 0
+	MaxBytes int // payload bytes queued across all buffered messages, 0 for no limit
+	Policy   QueuePolicy
+
+	ConnSize     int // messages queued per connection, 0 for no limit but Size
+	ConnMaxBytes int // payload bytes queued per connection, 0 for no limit but MaxBytes
+
+	// Weight returns the number of messages a connection from addr
+	// delivers in a row before the next connection's turn, 1 if nil.
+	// Connections take turns round robin among messages of the same
+	// priority.
+	Weight func(addr net.Addr) int
+}
+
+// QueueStats are counters of a Receiver's queues
+type QueueStats struct {
+	Len      int    // messages queued
+	Bytes    int    // payload bytes queued
+	Dropped  uint64 // messages dropped by QueueDropNewest or QueueDropOldest
+	Rejected uint64 // messages rejected by QueueReject
+}
+
+// PeerQueueStats is the depth of the queue of one connection
+type PeerQueueStats struct {
+	Addr  net.Addr // nil for messages sent by SendTo or over UDP
+	Len   int
+	Bytes int
+}
+
+// msgQueue holds the messages of a Receiver, in one inbound queue per
+// connection. Recv takes the message of highest priority, and the
+// connections which have one take turns.
+type msgQueue struct {
+	mu       sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	active   []*inbound // queues with messages, in turn order
+	next     int        // index in active of the queue having its turn
+	turn     int        // messages it may still deliver in a row
+	n        int        // messages queued in all queues
+	local    *inbound   // messages sent by SendTo or over UDP
+	cfg      QueueConfig
+	stats    QueueStats
+}
+
+// inbound is the queue of one connection. Messages wait in one lane per
+// priority, so that a heartbeat is not delivered after every bulk
+// message queued before it.
+type inbound struct {
+	addr   net.Addr
+	key    limitKey // of the rate limits of the peer
+	sess   *session // of the connection if flow controlled, see SetWindow
+	weight int
+	lanes  []*lane // by priority, highest first
+	n      int     // messages queued in all lanes
+	bytes  int
+	active bool // in msgQueue.active
+}
+
+// lane is a FIFO of messages of the same priority
+type lane struct {
+	prio int
+	msgs []*Message
+}
+
+func newMsgQueue(cfg QueueConfig) *msgQueue {
+	if cfg.Size <= 0 {
+		cfg.Size = chanBufSize
+	}
+	q := &msgQueue{cfg: cfg, next: -1}
+	q.notEmpty = sync.NewCond(&q.mu)
+	q.notFull = sync.NewCond(&q.mu)
+	q.local = q.newInbound(nil)
+	return q
+}
+
+// newInbound returns the queue of a new connection from addr
+func (q *msgQueue) newInbound(addr net.Addr) *inbound {
+	in := &inbound{addr: addr, key: hostKey(addr), weight: 1}
+	if q.cfg.Weight != nil && addr != nil {
+		if w := q.cfg.Weight(addr); w > 1 {
+			in.weight = w
+		}
+	}
+	return in
+}
+
+// msgSize is what a queued message counts against MaxBytes
+func msgSize(m *Message) int {
+	return len(m.bytes) + m.header.size()
+}
+
+// full reports whether m does not fit in the queues, or in the queue
+// of in. A message always fits in empty queues. q.mu must be held.
+func (q *msgQueue) full(in *inbound, m *Message) bool {
+	if q.n == 0 {
+		return false
+	}
+	if q.n >= q.cfg.Size || q.cfg.MaxBytes > 0 && q.stats.Bytes+msgSize(m) > q.cfg.MaxBytes {
+		return true
+	}
+	return q.connFull(in, m)
+}
+
+// connFull reports whether m does not fit in the queue of in,
+// a message always fits in an empty queue. q.mu must be held.
+func (q *msgQueue) connFull(in *inbound, m *Message) bool {
+	if in.n == 0 {
+		return false
+	}
+	return q.cfg.ConnSize > 0 && in.n >= q.cfg.ConnSize ||
+		q.cfg.ConnMaxBytes > 0 && in.bytes+msgSize(m) > q.cfg.ConnMaxBytes
+}
+
+// victim returns the queue QueueDropOldest drops a message from to make
+// room for m: the queue of in if that is full, else the longest queue.
+// q.mu must be held.
+func (q *msgQueue) victim(in *inbound, m *Message) *inbound {
+	if q.connFull(in, m) {
+		return in
+	}
+	v := in
+	for _, a := range q.active {
+		if a.n > v.n {
+			v = a
+		}
+	}
+	return v
+}
+
+// lane returns the lane of priority prio, adding it if needed
+func (in *inbound) lane(prio int) *lane {
+	i := 0
+	for i < len(in.lanes) && in.lanes[i].prio > prio {
+		i++
+	}
+	if i < len(in.lanes) && in.lanes[i].prio == prio {
+		return in.lanes[i]
+	}
+	l := &lane{prio: prio}
+	in.lanes = append(in.lanes, nil)
+	copy(in.lanes[i+1:], in.lanes[i:])
+	in.lanes[i] = l
+	return l
+}
+
+// highest returns the non-empty lane of highest priority,
+// in must not be empty
+func (in *inbound) highest() *lane {
+	for i := 0; ; i++ {
+		if len(in.lanes[i].msgs) > 0 {
+			return in.lanes[i]
+		}
+	}
+}
+
+// lowest returns the non-empty lane of lowest priority,
+// in must not be empty
+func (in *inbound) lowest() *lane {
+	for i := len(in.lanes) - 1; ; i-- {
+		if len(in.lanes[i].msgs) > 0 {
+			return in.lanes[i]
+		}
+	}
+}
+
+// push queues m in the queue of in according to the policy.
+// QueueDropOldest drops the oldest message of the lowest priority
+// of the victim queue, or m if that is higher than m's. QueueBlock
+// fails m with ErrReceiverClosed if stopping is closed while it waits.
+func (q *msgQueue) push(in *inbound, m *Message, stopping <-chan struct{}) {
+	var dropped []*Message
+	var rejected, closed bool
+	prio := m.Priority()
+
+	q.mu.Lock()
+	switch q.cfg.Policy {
+	case QueueBlock:
+		for q.full(in, m) {
+			if isClosed(stopping) {
+				closed = true
+				break
+			}
+			q.notFull.Wait()
+		}
+	case QueueDropNewest:
+		if q.full(in, m) {
+			dropped = append(dropped, m)
+			q.stats.Dropped++
+		}
+	case QueueDropOldest:
+		for q.full(in, m) {
+			v := q.victim(in, m)
+			if v.n == 0 || v.lowest().prio > prio {
+				dropped = append(dropped, m)
+				q.stats.Dropped++
+				break
+			}
+			dropped = append(dropped, q.shift(v, v.lowest()))
+			q.stats.Dropped++
+		}
+	case QueueReject:
+		if q.full(in, m) {
+			rejected = true
+			q.stats.Rejected++
+		}
+	}
+	if !rejected && !closed && (len(dropped) == 0 || dropped[len(dropped)-1] != m) {
+		l := in.lane(prio)
+		l.msgs = append(l.msgs, m)
+		in.n++
+		in.bytes += msgSize(m)
+		q.n++
+		q.stats.Bytes += msgSize(m)
+		if !in.active {
+			in.active = true
+			q.active = append(q.active, in)
+		}
+		q.notEmpty.Signal()
+	}
+	q.mu.Unlock()
+
+	if rejected || closed || len(dropped) > 0 && dropped[len(dropped)-1] == m {
+		in.release()
+	}
+	if rejected {
+		m.fail(ErrQueueFull)
+	}
+	if closed {
+		m.fail(ErrReceiverClosed)
+	}
+	for _, d := range dropped {
+		log.Warning("Receiver drops message of type ", typeName(d.msgType), ": ", ErrQueueFull)
+		d.fail(ErrQueueFull)
+	}
+}
+
+// wake wakes the deliveries waiting for room, e.g. to see the
+// receiver stopped
+func (q *msgQueue) wake() {
+	q.mu.Lock()
+	q.notFull.Broadcast()
+	q.mu.Unlock()
+}
+
+// shift removes the oldest message of lane l of in, and takes in out
+// of the turn order once it is empty. q.mu must be held.
+func (q *msgQueue) shift(in *inbound, l *lane) *Message {
+	m := l.msgs[0]
+	l.msgs[0] = nil
+	l.msgs = l.msgs[1:]
+	in.n--
+	in.bytes -= msgSize(m)
+	q.n--
+	q.stats.Bytes -= msgSize(m)
+	q.notFull.Broadcast()
+	in.release()
+	if in.n == 0 {
+		q.remove(in)
+	}
+	return m
+}
+
+// remove takes in out of the turn order, the next queue takes
+// the turn if in has it. q.mu must be held.
+func (q *msgQueue) remove(in *inbound) {
+	for i, a := range q.active {
+		if a != in {
+			continue
+		}
+		in.active = false
+		copy(q.active[i:], q.active[i+1:])
+		q.active[len(q.active)-1] = nil
+		q.active = q.active[:len(q.active)-1]
+		if i <= q.next {
+			if i == q.next {
+				q.turn = 0
+			}
+			q.next--
+		}
+		return
+	}
+}
+
+// release gives the credit of a message of in back to its sender
+func (in *inbound) release() {
+	if in.sess != nil {
+		in.sess.release()
+	}
+}
+
+// pop returns the oldest message of the highest priority queued, taken
+// from the queue having its turn, waiting for one if block is set
+func (q *msgQueue) pop(block bool) *Message {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.n == 0 {
+		if !block {
+			return nil
+		}
+		q.notEmpty.Wait()
+	}
+
+	prio := math.MinInt32
+	for _, in := range q.active {
+		if p := in.highest().prio; p > prio {
+			prio = p
+		}
+	}
+	// the queue having its turn keeps it while it has messages of
+	// that priority, else the turn passes to the next which has
+	if q.turn <= 0 || q.active[q.next].highest().prio != prio {
+		for i := 1; i <= len(q.active); i++ {
+			j := (q.next + i) % len(q.active)
+			if q.active[j].highest().prio == prio {
+				q.next, q.turn = j, q.active[j].weight
+				break
+			}
+		}
+	}
+
+	in := q.active[q.next]
+	q.turn--
+	return q.shift(in, in.highest())
+}
+
+// peerStats returns the depth of the queues which have messages
+func (q *msgQueue) peerStats() []PeerQueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	stats := make([]PeerQueueStats, 0, len(q.active))
+	for _, in := range q.active {
+		stats = append(stats, PeerQueueStats{Addr: in.addr, Len: in.n, Bytes: in.bytes})
+	}
+	return stats
+}
+
+func (q *msgQueue) Stats() QueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	stats := q.stats
+	stats.Len = q.n
+	return stats
+}
+
+// SetQueue configures the queues of messages held until they are
+// received by Recv, it must be called before the receiver is started
+func (r *Receiver) SetQueue(cfg QueueConfig) {
+	r.q = newMsgQueue(cfg)
+}
+
+// QueueStats returns the counters of the receiver's queues
+func (r *Receiver) QueueStats() QueueStats { return r.q.Stats() }
+
+// PeerQueueStats returns the depth of the queue of every connection
+// which has messages waiting for Recv
+func (r *Receiver) PeerQueueStats() []PeerQueueStats { return r.q.peerStats() }
@@ -0,0 +1,198 @@
+package message
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func fillQueue(r *Receiver, payloads ...string) {
+	for _, p := range payloads {
+		SendTo(r, NewMessage(1, []byte(p)))
+	}
+}
+
+func expectRecv(t *testing.T, r *Receiver, payloads ...string) {
+	for _, p := range payloads {
+		if msg := r.Recv(); string(msg.Bytes()) != p {
+			t.Fatal("expect ", p, ", got ", string(msg.Bytes()))
+		}
+	}
+	if msg := r.GoRecv(); msg != nil {
+		t.Fatal("unexpected message ", string(msg.Bytes()))
+	}
+}
+
+func TestQueueDropNewest(t *testing.T) {
+	r := NewReceiver("127.0.0.1:0")
+	r.SetQueue(QueueConfig{Size: 2, Policy: QueueDropNewest})
+
+	fillQueue(r, "1", "2", "3")
+	expectRecv(t, r, "1", "2")
+	if r.QueueStats().Dropped != 1 {
+		t.Fatal("expect 1 dropped message")
+	}
+}
+
+func TestQueueDropOldest(t *testing.T) {
+	r := NewReceiver("127.0.0.1:0")
+	r.SetQueue(QueueConfig{Size: 2, Policy: QueueDropOldest})
+
+	fillQueue(r, "1", "2", "3")
+	expectRecv(t, r, "2", "3")
+	if r.QueueStats().Dropped != 1 {
+		t.Fatal("expect 1 dropped message")
+	}
+}
+
+func TestQueueMaxBytes(t *testing.T) {
+	r := NewReceiver("127.0.0.1:0")
+	r.SetQueue(QueueConfig{Size: 10, MaxBytes: 10, Policy: QueueDropNewest})
+
+	fillQueue(r, "12345678", "12345678", "12")
+	if stats := r.QueueStats(); stats.Len != 2 || stats.Bytes != 10 || stats.Dropped != 1 {
+		t.Fatal("unexpected stats ", stats)
+	}
+	expectRecv(t, r, "12345678", "12")
+}
+
+func TestQueueBlock(t *testing.T) {
+	r := NewReceiver("127.0.0.1:0")
+	r.SetQueue(QueueConfig{Size: 1})
+
+	done := make(chan bool)
+	go func() {
+		fillQueue(r, "1", "2")
+		done <- true
+	}()
+	select {
+	case <-done:
+		t.Fatal("expect the second message to wait for room")
+	case <-time.After(50 * time.Millisecond):
+	}
+	expectRecv(t, r, "1")
+	<-done
+	expectRecv(t, r, "2")
+}
+
+func TestQueueReject(t *testing.T) {
+	r := NewReceiver("127.0.0.1:0")
+	r.SetQueue(QueueConfig{Size: 1, Policy: QueueReject})
+	if err := r.GoStart(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	fillQueue(r, "1")
+	sender, err := NewSender(r.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sender.Send(NewMessage(MsgRequireReply+1, nil)); err != ErrQueueFull {
+		t.Fatal("expect ErrQueueFull, got ", err)
+	}
+	if r.QueueStats().Rejected != 1 {
+		t.Fatal("expect 1 rejected message")
+	}
+}
+
+// Test a dropped request is replied ErrQueueFull instead of left waiting
+func TestQueueDropRequest(t *testing.T) {
+	r := NewReceiver("127.0.0.1:0")
+	r.SetQueue(QueueConfig{Size: 1, Policy: QueueDropNewest})
+	if err := r.GoStart(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	fillQueue(r, "1")
+	sender, err := NewSender(r.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := sender.Send(NewRequest(200, nil))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != ErrQueueFull {
+			t.Fatal("expect ErrQueueFull, got ", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expect the dropped request to be replied")
+	}
+	if r.QueueStats().Dropped != 1 {
+		t.Fatal("expect 1 dropped message")
+	}
+}
+
+func deliverFrom(r *Receiver, in *inbound, payloads ...string) {
+	for _, p := range payloads {
+		r.deliver(in, NewMessage(1, []byte(p)))
+	}
+}
+
+func TestQueueRoundRobin(t *testing.T) {
+	r := NewReceiver("127.0.0.1:0")
+	a := r.q.newInbound(&net.TCPAddr{Port: 1})
+	b := r.q.newInbound(&net.TCPAddr{Port: 2})
+
+	deliverFrom(r, a, "a1", "a2", "a3")
+	deliverFrom(r, b, "b1", "b2")
+	stats := r.PeerQueueStats()
+	if len(stats) != 2 || stats[0].Len != 3 || stats[1].Len != 2 || stats[1].Bytes != 4 {
+		t.Fatal("unexpected stats ", stats)
+	}
+	expectRecv(t, r, "a1", "b1", "a2", "b2", "a3")
+	if stats := r.PeerQueueStats(); len(stats) != 0 {
+		t.Fatal("unexpected stats ", stats)
+	}
+}
+
+func TestQueueWeighted(t *testing.T) {
+	r := NewReceiver("127.0.0.1:0")
+	r.SetQueue(QueueConfig{Weight: func(addr net.Addr) int {
+		return addr.(*net.TCPAddr).Port
+	}})
+	a := r.q.newInbound(&net.TCPAddr{Port: 2})
+	b := r.q.newInbound(&net.TCPAddr{Port: 1})
+
+	deliverFrom(r, a, "a1", "a2", "a3", "a4")
+	deliverFrom(r, b, "b1", "b2")
+	expectRecv(t, r, "a1", "a2", "b1", "a3", "a4", "b2")
+}
+
+// Test a full connection does not hold the messages of the others
+func TestQueuePerConn(t *testing.T) {
+	r := NewReceiver("127.0.0.1:0")
+	r.SetQueue(QueueConfig{ConnSize: 2, Policy: QueueDropNewest})
+	a := r.q.newInbound(&net.TCPAddr{Port: 1})
+	b := r.q.newInbound(&net.TCPAddr{Port: 2})
+
+	deliverFrom(r, a, "a1", "a2", "a3")
+	deliverFrom(r, b, "b1")
+	expectRecv(t, r, "a1", "b1", "a2")
+	if r.QueueStats().Dropped != 1 {
+		t.Fatal("expect 1 dropped message")
+	}
+}
+
+// Test the receiver-wide Size holds whatever the connections
+func TestQueueSizeAcrossConns(t *testing.T) {
+	r := NewReceiver("127.0.0.1:0")
+	r.SetQueue(QueueConfig{Size: 3, ConnSize: 2, Policy: QueueDropOldest})
+	a := r.q.newInbound(&net.TCPAddr{Port: 1})
+	b := r.q.newInbound(&net.TCPAddr{Port: 2})
+	c := r.q.newInbound(&net.TCPAddr{Port: 3})
+
+	deliverFrom(r, a, "a1", "a2", "a3")
+	deliverFrom(r, b, "b1")
+	// drops the oldest of the longest queue
+	deliverFrom(r, c, "c1")
+	if stats := r.QueueStats(); stats.Len != 3 || stats.Dropped != 2 {
+		t.Fatal("unexpected stats ", stats)
+	}
+	expectRecv(t, r, "a3", "b1", "c1")
+}
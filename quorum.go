@@ -0,0 +1,90 @@
+package message
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	ErrNoQuorum = errors.New("message: quorum not reached")
+)
+
+type result struct {
+	i     int
+	reply *PbMessage
+	err   error
+}
+
+// fanOut sends msg to every peer concurrently until ctx is done. The
+// result channel is buffered, so senders never block on a caller that
+// stopped listening.
+func fanOut(ctx context.Context, peers []*PbSender, msg *PbMessage) <-chan result {
+	ch := make(chan result, len(peers))
+	for i, s := range peers {
+		go func(i int, s *PbSender) {
+			reply, err := s.SendContext(ctx, msg)
+			ch <- result{i, reply, err}
+		}(i, s)
+	}
+	return ch
+}
+
+// Broadcast sends msg to every peer concurrently and waits for all of them.
+// replies[i] is the reply of peers[i], failed maps the index of every peer
+// which failed to its error.
+func Broadcast(peers []*PbSender, msg *PbMessage) (replies []*PbMessage, failed map[int]error) {
+	replies = make([]*PbMessage, len(peers))
+	failed = make(map[int]error)
+
+	ch := fanOut(context.Background(), peers, msg)
+	for range peers {
+		r := <-ch
+		if r.err != nil {
+			failed[r.i] = r.err
+			continue
+		}
+		replies[r.i] = r.reply
+	}
+	return replies, failed
+}
+
+// Quorum sends msg to every peer concurrently and returns as soon as k of
+// them replied, e.g. a fast quorum of PreAcceptReply. replies[i] is the
+// reply of peers[i] or nil, failed maps the index of every peer which
+// failed so far to its error. ErrNoQuorum is returned if the timeout
+// expires or too many peers failed to ever reach k replies.
+//
+// The requests still in flight are canceled once Quorum returns, see
+// PbSender.SendContext: their connections are closed, and the handlers
+// see their contexts canceled. The senders dial again on their next Send.
+func Quorum(peers []*PbSender, msg *PbMessage, k int, timeout time.Duration) (replies []*PbMessage, failed map[int]error, err error) {
+	replies = make([]*PbMessage, len(peers))
+	failed = make(map[int]error)
+	if k > len(peers) {
+		return replies, failed, ErrNoQuorum
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	ch := fanOut(ctx, peers, msg)
+	ok := 0
+	for ok < k {
+		select {
+		case r := <-ch:
+			if r.err != nil {
+				failed[r.i] = r.err
+				if len(peers)-len(failed) < k {
+					return replies, failed, ErrNoQuorum
+				}
+				continue
+			}
+			replies[r.i] = r.reply
+			ok++
+		case <-ctx.Done():
+			return replies, failed, ErrNoQuorum
+		}
+	}
+	return replies, failed, nil
+}
@@ -0,0 +1,166 @@
+package message
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-epaxos/message/example"
+)
+
+// start three receivers, the last one replies after delay
+func startReplicas(t *testing.T, delay time.Duration) ([]*PbReceiver, []*PbSender) {
+	register(MsgRequireReply+1, reflect.TypeOf(example.PreAccept{}))
+	rs := make([]*PbReceiver, 3)
+	for i := range rs {
+		rs[i] = NewPbReceiver("127.0.0.1:0")
+		if err := rs[i].GoStart(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	go pbEcho(rs[0])
+	go pbEcho(rs[1])
+	go func() {
+		for {
+			msg := rs[2].Recv()
+			time.Sleep(delay)
+			msg.reply <- msg
+		}
+	}()
+
+	ss := make([]*PbSender, len(rs))
+	for i, r := range rs {
+		s, err := NewPbSender(r.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		ss[i] = s
+	}
+	return rs, ss
+}
+
+func TestBroadcast(t *testing.T) {
+	rs, ss := startReplicas(t, 0)
+	for _, r := range rs {
+		defer r.Stop()
+	}
+
+	msg := NewPbMessage(MsgRequireReply+1, NewPreAcceptSample())
+	replies, failed := Broadcast(ss, msg)
+	if len(failed) != 0 {
+		t.Fatal(failed)
+	}
+	for _, reply := range replies {
+		if !reflect.DeepEqual(msg.Proto(), reply.Proto()) {
+			t.Fatal("error recv!")
+		}
+	}
+}
+
+func TestQuorum(t *testing.T) {
+	rs, ss := startReplicas(t, 500*time.Millisecond)
+	for _, r := range rs {
+		defer r.Stop()
+	}
+
+	msg := NewPbMessage(MsgRequireReply+1, NewPreAcceptSample())
+	start := time.Now()
+	replies, failed, err := Quorum(ss, msg, 2, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) > 250*time.Millisecond {
+		t.Fatal("Quorum should not wait for the slow replica")
+	}
+	if len(failed) != 0 || replies[0] == nil || replies[1] == nil || replies[2] != nil {
+		t.Fatal("unexpected replies ", replies, failed)
+	}
+
+	// a quorum of all three can not be reached in time
+	_, failed, err = Quorum(ss, msg, 3, 100*time.Millisecond)
+	if err != ErrNoQuorum {
+		t.Fatal("expect ErrNoQuorum, got ", err)
+	}
+	if len(failed) != 0 {
+		t.Fatal("expect the timeout to expire, not peers to fail ", failed)
+	}
+
+	// the slow replica is reached again once it caught up
+	if _, failed, err := Quorum(ss, msg, 3, 3*time.Second); err != nil {
+		t.Fatal(err, failed)
+	}
+}
+
+func TestQuorumFailed(t *testing.T) {
+	rs, ss := startReplicas(t, 0)
+	for _, r := range rs {
+		defer r.Stop()
+	}
+	ss[1].conn.Close()
+
+	msg := NewPbMessage(MsgRequireReply+1, NewPreAcceptSample())
+	_, failed, err := Quorum(ss, msg, 3, time.Second)
+	if err != ErrNoQuorum {
+		t.Fatal("expect ErrNoQuorum, got ", err)
+	}
+	if _, ok := failed[1]; !ok || len(failed) != 1 {
+		t.Fatal("unexpected failed peers ", failed)
+	}
+}
+
+// Test the request of the slow peer is canceled once the quorum is reached
+func TestQuorumCancel(t *testing.T) {
+	register(MsgRequireReply+1, reflect.TypeOf(example.PreAccept{}))
+	ss := make([]*PbSender, 3)
+	canceled := make(chan bool, 1)
+	for i := range ss {
+		r := NewPbReceiver("127.0.0.1:0")
+		if err := r.GoStart(); err != nil {
+			t.Fatal(err)
+		}
+		defer r.Stop()
+		if i < 2 {
+			go pbEcho(r)
+		} else {
+			go func() {
+				msg := r.Recv()
+				select {
+				case <-msg.Context().Done():
+					canceled <- true
+				case <-time.After(time.Second):
+					canceled <- false
+				}
+				msg.reply <- msg
+				pbEcho(r)
+			}()
+		}
+
+		s, err := NewPbSender(r.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		ss[i] = s
+	}
+
+	msg := NewPbMessage(MsgRequireReply+1, NewPreAcceptSample())
+	if _, _, err := Quorum(ss, msg, 2, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if !<-canceled {
+		t.Fatal("expect the slow peer's handler to see the request canceled")
+	}
+	// Send dials again and does not wait for the reply of the canceled request
+	done := make(chan error, 1)
+	go func() {
+		_, err := ss[2].Send(msg)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expect Send not to wait for the reply of the canceled request")
+	}
+}
@@ -0,0 +1,235 @@
+package message
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LimitAction tells a receiver what to do with a message over its limit
+type LimitAction int
+
+const (
+	// LimitDelay holds the message until the limit allows it,
+	// which stops reading its connection meanwhile
+	LimitDelay LimitAction = iota
+	// LimitReject replies ErrRateLimited to the message
+	// if it requires reply, and drops it otherwise
+	LimitReject
+)
+
+const (
+	maxLimitBuckets = 1024 // peers tracked before idle ones are forgotten
+)
+
+var (
+	ErrRateLimited = errors.New("message: rate limit exceeded")
+)
+
+// Limit is a token bucket: messages are accepted at Rate per second
+// on average, in bursts of up to Burst messages
+type Limit struct {
+	Rate   float64 // messages per second, 0 for no limit
+	Burst  int     // 1 if less
+	Action LimitAction
+}
+
+// RateLimits are the limits of the messages a receiver accepts. A message
+// must be within the limit of its peer and the limit of its type. Every
+// peer has a bucket of its own, while all peers share the bucket of a type.
+type RateLimits struct {
+	Peer  Limit            // of every peer, unless overridden below
+	Hosts map[string]Limit // of the peers connecting from a host, by IP
+	Nodes map[NodeID]Limit // of the replicas of the mesh
+	Types map[uint16]Limit // of every message type, messages sent by SendTo included
+}
+
+// limitKey identifies the sender of a message, by node ID
+// for replicas of the mesh, else by host
+type limitKey struct {
+	node   NodeID
+	isNode bool
+	host   string
+}
+
+// hostKey returns the key of a peer connecting from addr,
+// the zero key, which is not limited, if addr is nil
+func hostKey(addr net.Addr) limitKey {
+	if addr == nil {
+		return limitKey{}
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	return limitKey{host: host}
+}
+
+func nodeKey(id NodeID) limitKey { return limitKey{node: id, isNode: true} }
+
+type bucket struct {
+	limit  Limit
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(l Limit, now time.Time) *bucket {
+	if l.Burst < 1 {
+		l.Burst = 1
+	}
+	return &bucket{limit: l, tokens: float64(l.Burst), last: now}
+}
+
+// refill adds the tokens earned since the last refill
+func (b *bucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.limit.Rate
+	if max := float64(b.limit.Burst); b.tokens > max {
+		b.tokens = max
+	}
+	b.last = now
+}
+
+// full reports whether the bucket is back to its burst
+func (b *bucket) full() bool { return b.tokens >= float64(b.limit.Burst) }
+
+// rejects reports whether a message would be rejected
+func (b *bucket) rejects() bool {
+	return b.limit.Action == LimitReject && b.tokens < 1
+}
+
+// take takes a token, possibly in advance, and returns how long to wait
+// until it is earned
+func (b *bucket) take() time.Duration {
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.limit.Rate * float64(time.Second))
+}
+
+// limiter applies RateLimits
+type limiter struct {
+	limited uint64 // messages rejected, first for atomic alignment
+
+	mu    sync.Mutex
+	cfg   RateLimits
+	peers map[limitKey]*bucket
+	types map[uint16]*bucket
+}
+
+func newLimiter(cfg RateLimits) *limiter {
+	return &limiter{
+		cfg:   cfg,
+		peers: make(map[limitKey]*bucket),
+		types: make(map[uint16]*bucket),
+	}
+}
+
+// peerLimit returns the limit of a peer
+func (l *limiter) peerLimit(key limitKey) Limit {
+	if lim, ok := l.cfg.Nodes[key.node]; ok && key.isNode {
+		return lim
+	}
+	if lim, ok := l.cfg.Hosts[key.host]; ok && !key.isNode {
+		return lim
+	}
+	return l.cfg.Peer
+}
+
+// peerBucket returns the bucket of a peer, nil if it is not limited.
+// l.mu must be held.
+func (l *limiter) peerBucket(key limitKey, now time.Time) *bucket {
+	if key == (limitKey{}) {
+		return nil
+	}
+	if b := l.peers[key]; b != nil {
+		return b
+	}
+	lim := l.peerLimit(key)
+	if lim.Rate <= 0 {
+		return nil
+	}
+	if len(l.peers) >= maxLimitBuckets {
+		// a full bucket is the same as a new one
+		for k, b := range l.peers {
+			if b.refill(now); b.full() {
+				delete(l.peers, k)
+			}
+		}
+	}
+	b := newBucket(lim, now)
+	l.peers[key] = b
+	return b
+}
+
+// typeBucket returns the bucket of a message type, nil if it is not
+// limited. l.mu must be held.
+func (l *limiter) typeBucket(msgType uint16, now time.Time) *bucket {
+	if b := l.types[msgType]; b != nil {
+		return b
+	}
+	lim, ok := l.cfg.Types[msgType]
+	if !ok || lim.Rate <= 0 {
+		return nil
+	}
+	b := newBucket(lim, now)
+	l.types[msgType] = b
+	return b
+}
+
+// admit reports whether a message of type msgType from the peer of key
+// is accepted, after waiting until its limits allow it if needed
+func (l *limiter) admit(key limitKey, msgType uint16) bool {
+	now := time.Now()
+	l.mu.Lock()
+	var buckets []*bucket
+	for _, b := range []*bucket{l.peerBucket(key, now), l.typeBucket(msgType, now)} {
+		if b == nil {
+			continue
+		}
+		b.refill(now)
+		if b.rejects() {
+			l.mu.Unlock()
+			atomic.AddUint64(&l.limited, 1)
+			return false
+		}
+		buckets = append(buckets, b)
+	}
+	var wait time.Duration
+	for _, b := range buckets {
+		if d := b.take(); d > wait {
+			wait = d
+		}
+	}
+	l.mu.Unlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+	return true
+}
+
+// SetLimits limits the messages the receiver accepts,
+// it must be called before the receiver is started
+func (r *Receiver) SetLimits(cfg RateLimits) { r.limits = newLimiter(cfg) }
+
+// RateLimitedCount returns the number of messages rejected by the limits
+func (r *Receiver) RateLimitedCount() uint64 {
+	if r.limits == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&r.limits.limited)
+}
+
+// SetLimits limits the messages the receiver accepts, see Receiver.SetLimits
+func (r *PbReceiver) SetLimits(cfg RateLimits) { r.limits = newLimiter(cfg) }
+
+// RateLimitedCount returns the number of messages rejected by the limits
+func (r *PbReceiver) RateLimitedCount() uint64 {
+	if r.limits == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&r.limits.limited)
+}
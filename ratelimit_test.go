@@ -0,0 +1,130 @@
+package message
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRateLimitReject(t *testing.T) {
+	r := NewReceiver("127.0.0.1:0")
+	r.SetLimits(RateLimits{Peer: Limit{Rate: 1, Burst: 2, Action: LimitReject}})
+	if err := r.GoStart(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+	go echo(r)
+
+	sender, err := NewSender(r.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := sender.Send(NewRequest(1, nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := sender.Send(NewRequest(1, nil)); err != ErrRateLimited {
+		t.Fatal("expect ErrRateLimited, got ", err)
+	}
+	if r.RateLimitedCount() != 1 {
+		t.Fatal("expect 1 rejected message")
+	}
+}
+
+func TestRateLimitDelay(t *testing.T) {
+	r := NewReceiver("127.0.0.1:0")
+	r.SetLimits(RateLimits{Types: map[uint16]Limit{5: {Rate: 20}}})
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		SendTo(r, NewMessage(5, nil))
+		r.Recv()
+	}
+	if d := time.Since(start); d < 90*time.Millisecond {
+		t.Fatal("messages are not delayed, took ", d)
+	}
+	// other types are not limited
+	start = time.Now()
+	for i := 0; i < 3; i++ {
+		SendTo(r, NewMessage(6, nil))
+		r.Recv()
+	}
+	if d := time.Since(start); d > 40*time.Millisecond {
+		t.Fatal("messages are delayed, took ", d)
+	}
+}
+
+// Test datagrams are limited per peer although they share a queue
+func TestRateLimitUDP(t *testing.T) {
+	r := NewReceiver("127.0.0.1:0")
+	r.SetLimits(RateLimits{Peer: Limit{Rate: 1, Burst: 2, Action: LimitReject}})
+	if err := r.GoStart(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.GoStartUDP(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	sender, err := NewUDPSender(r.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := sender.Send(NewMessage(1, nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.Recv()
+	r.Recv()
+	deadline := time.Now().Add(time.Second)
+	for r.RateLimitedCount() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("expect 1 rejected datagram")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRateLimitHosts(t *testing.T) {
+	l := newLimiter(RateLimits{
+		Hosts: map[string]Limit{"10.0.0.1": {Rate: 1, Action: LimitReject}},
+		Nodes: map[NodeID]Limit{1: {Rate: 1, Action: LimitReject}},
+	})
+	limited := hostKey(&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1000})
+	other := hostKey(&net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 1000})
+
+	for i, admitted := range []bool{true, false} {
+		if l.admit(limited, 1) != admitted {
+			t.Fatal("unexpected admission of host message ", i)
+		}
+		if l.admit(nodeKey(1), 1) != admitted {
+			t.Fatal("unexpected admission of node message ", i)
+		}
+		if !l.admit(other, 1) || !l.admit(nodeKey(2), 1) {
+			t.Fatal("expect other peers not to be limited")
+		}
+	}
+	// the bucket is per host, not per connection
+	again := hostKey(&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 2000})
+	if l.admit(again, 1) {
+		t.Fatal("expect a new connection from the host to be limited")
+	}
+}
+
+func TestPbRateLimit(t *testing.T) {
+	r := NewPbReceiver("127.0.0.1:0")
+	r.SetLimits(RateLimits{Types: map[uint16]Limit{1: {Rate: 1, Action: LimitReject}}})
+	go func() {
+		msg := r.Recv()
+		msg.reply <- NewEmptyPbMessage()
+	}()
+
+	if reply := PbSendTo(r, NewPbRequest(1, nil)); reply.Err() != nil {
+		t.Fatal(reply.Err())
+	}
+	if reply := PbSendTo(r, NewPbRequest(1, nil)); reply.Err() != ErrRateLimited {
+		t.Fatal("expect ErrRateLimited, got ", reply.Err())
+	}
+}
@@ -1,6 +1,7 @@
 package message
 
 import (
+	"context"
 	"io"
 	"net"
 	"time"
@@ -9,16 +10,20 @@ import (
 )
 
 const (
-	chanBufSize = 10 // buffer size for message channel, default = 10
+	chanBufSize = 10 // default size of the receiver queue, see SetQueue
 )
 
 // Receiver struct
 type Receiver struct {
-	localAddr    *net.TCPAddr     // address
-	ln           *net.TCPListener // only TCP now
-	ch           chan *Message    // message channel
-	stop         bool             // stop?
+	expired uint64 // expired messages dropped, first for atomic alignment
+
+	localAddr    *net.TCPAddr // address
+	lc           *lifecycle   // listeners and connections, see Shutdown
+	q            *msgQueue    // messages waiting for Recv
 	replyTimeout time.Duration
+	mesh         *Mesh    // accepts connections from other replicas
+	limits       *limiter // nil if not limited, see SetLimits
+	window       uint32   // see SetWindow
 }
 
 // Constructor
@@ -30,31 +35,61 @@ func NewReceiver(addrStr string) *Receiver {
 		return nil
 	}
 	r.localAddr = addr
-	r.ch = make(chan *Message, chanBufSize)
+	r.lc = newLifecycle()
+	r.q = newMsgQueue(QueueConfig{})
+	r.lc.onStop = func() { r.q.wake() }
 	// TODO: this should be configurable
 	r.replyTimeout = time.Millisecond * 50
 	return r
 }
 
 // Recv() will blocking until there is message
+// Expired messages are dropped, see SetExpiry
 func (r *Receiver) Recv() *Message {
-	return <-r.ch
+	for {
+		m := r.q.pop(true)
+		if !r.dropExpired(m) {
+			return m
+		}
+	}
 }
 
 // GoRecv() will return message if possible, or nil if no message
 func (r *Receiver) GoRecv() *Message {
-	select {
-	case m := <-r.ch:
-		return m
-	default:
-		return nil
+	for {
+		m := r.q.pop(false)
+		if m == nil || !r.dropExpired(m) {
+			return m
+		}
+	}
+}
+
+// deliver queues a message received on the connection of in for Recv,
+// unless the receiver is stopped or the message is over the rate limits
+func (r *Receiver) deliver(in *inbound, m *Message) {
+	r.deliverFrom(in.key, in, m)
+}
+
+// deliverFrom is like deliver for a message whose peer is not the one
+// of in, e.g. a datagram queued with the messages sent by SendTo
+func (r *Receiver) deliverFrom(key limitKey, in *inbound, m *Message) {
+	if r.lc.stopped() {
+		in.release()
+		m.fail(ErrReceiverClosed)
+		return
+	}
+	if r.limits != nil && !r.limits.admit(key, m.msgType) {
+		in.release()
+		m.fail(ErrRateLimited)
+		return
 	}
+	r.q.push(in, m, r.lc.stoppingChan())
 }
 
 // Send a message to a local receiver
 func SendTo(r *Receiver, m *Message) *Message {
 	attached := m.AttachReplyChan()
-	r.ch <- m
+	r.deliver(r.q.local, m)
 	if attached {
 		reply := <-m.reply
 		return reply
@@ -62,50 +97,90 @@ func SendTo(r *Receiver, m *Message) *Message {
 	return nil
 }
 
-func (r *Receiver) GoStart() {
-	go r.Start()
+// GoStart is like Start, but serves the connections on a goroutine of
+// its own. The receiver is ready once GoStart returns without error.
+func (r *Receiver) GoStart() error {
+	ln, err := r.Listen()
+	if err != nil {
+		return err
+	}
+	r.lc.listen(ln)
+	go func() {
+		if err := r.lc.accept(ln, r.handleConn); err != nil {
+			log.Error("Accept() error: ", err)
+		}
+	}()
+	return nil
 }
 
-// Stop the receiver
+// Stop the receiver at once: the listeners and the connections are
+// closed, requests in flight are not replied. See Shutdown.
 func (r *Receiver) Stop() error {
-	r.stop = true
-	err := r.ln.Close()
+	return r.lc.close()
+}
+
+// Shutdown stops the receiver gracefully: it stops accepting connections
+// and messages, waits for the requests in flight to be replied, closes
+// the connections and waits for the goroutines serving them. It returns
+// ctx.Err() if ctx is done first, the connections are closed anyway.
+// Messages already queued can still be received by Recv.
+func (r *Receiver) Shutdown(ctx context.Context) error {
+	return r.lc.shutdown(ctx)
+}
+
+// Start listens and serves connections until the receiver is stopped.
+// It returns the error of Listen at once, see Serve.
+func (r *Receiver) Start() error {
+	ln, err := r.Listen()
 	if err != nil {
 		return err
 	}
-	return nil
+	return r.Serve(ln)
 }
 
-// Start listen and receive messages
-func (r *Receiver) Start() {
+// Listen listens on the address of the receiver, a port of 0 picks a
+// free port, see Addr. Its connections are served by Serve.
+func (r *Receiver) Listen() (net.Listener, error) {
 	ln, err := net.ListenTCP("tcp", r.localAddr)
 	if err != nil {
-		log.Error("Listen() error: ", err)
-		return
-	}
-	r.ln = ln
-	for {
-		conn, err := r.ln.AcceptTCP()
-		if err != nil {
-			if r.stop {
-				return
-			}
-			log.Warning("Accept() error: ", err)
-			// TODO: is it a temp error?
-			// need to check!
-			continue
-		}
-		go r.handleConn(conn)
+		return nil, err
 	}
+	return ln, nil
+}
+
+// Serve serves the connections accepted from ln, which may be any
+// stream listener, e.g. one inherited from a parent process. It returns
+// nil once the receiver is stopped, which closes ln, or the error which
+// broke ln. A stopped receiver serves again once Stop or Shutdown returned.
+func (r *Receiver) Serve(ln net.Listener) error {
+	r.lc.listen(ln)
+	return r.lc.accept(ln, r.handleConn)
 }
 
+// Ready returns a channel closed once the receiver listens for connections
+func (r *Receiver) Ready() <-chan struct{} { return r.lc.readyChan() }
+
+// Addr returns the address the receiver listens on,
+// nil until it is ready
+func (r *Receiver) Addr() net.Addr { return r.lc.Addr() }
+
 // handleConn handles incoming connections
 // It decodes a message from TCP stream and sends it to channel
 func (r *Receiver) handleConn(conn net.Conn) {
 	d := NewMsgDecoder(conn)
 	e := NewMsgEncoder(conn)
 
+	// plain connections can not carry pushed messages
+	c := &Conn{conn: conn}
+	in := r.q.newInbound(conn.RemoteAddr())
+
 	for {
+		// the sender may switch to the session format between requests
+		if d.isSessionPreamble() {
+			r.handleSession(conn, d, e)
+			return
+		}
+
 		// create an empty message with reply channel
 		msg := NewEmptyMessage()
 
@@ -119,23 +194,80 @@ func (r *Receiver) handleConn(conn net.Conn) {
 			return
 		}
 
+		msg.conn = c
 		attached := msg.AttachReplyChan()
+		if attached {
+			r.lc.begin()
+		}
 
 		// send received message for processing
-		r.ch <- msg
+		r.deliver(in, msg)
 
 		if attached {
 			// wait for reply
 			replyMsg := <-msg.reply
 			if replyMsg != nil {
+				checkReply(msg.msgType, replyMsg.msgType)
 				if err := e.Encode(replyMsg); err != nil {
 					if err == io.EOF {
+						r.lc.end()
 						return
 					}
 					// TODO: handle error
-					log.Warning("handleConn() error: ", err)
+					log.Warning("handleConn() error: ", err, " replying to ", typeName(msg.msgType))
 				}
 			}
+			r.lc.end()
+		}
+	}
+}
+
+// handleSession handles connections in the session format, opened
+// by other replicas of the mesh or by senders which accept pushes
+func (r *Receiver) handleSession(conn net.Conn, d *MsgDecoder, e *MsgEncoder) {
+	if err := grantWindow(e, r.window); err != nil {
+		log.Warning("handleSession() error: ", err)
+		conn.Close()
+		return
+	}
+
+	first := NewEmptyMessage()
+	kind, id, err := d.decodeFrame(first)
+	if err != nil {
+		log.Warning("handleSession() error: ", err)
+		conn.Close()
+		return
+	}
+
+	if kind == frameHello {
+		if r.mesh == nil {
+			log.Warning("handleSession() error: ", ErrBadFrame)
+			conn.Close()
+			return
 		}
+		if c := r.mesh.accept(conn, d, e, NodeID(id)); c != nil {
+			c.run()
+		}
+		return
+	}
+
+	c := &Conn{conn: conn}
+	in := r.q.newInbound(conn.RemoteAddr())
+	c.sess = newSession(conn, d, e, func(msg *Message) {
+		msg.conn = c
+		r.deliver(in, msg)
+	})
+	c.sess.window = r.window
+	c.sess.track = r.lc
+	in.sess = c.sess
+	if !r.lc.track(c.sess) {
+		return
+	}
+	defer r.lc.untrack(c.sess)
+	if err := c.sess.dispatch(kind, id, first); err != nil {
+		log.Warning("handleSession() error: ", err)
+		c.sess.close(err)
+		return
 	}
+	c.sess.run()
 }
@@ -17,8 +17,10 @@ import (
 func TestBlockRecv(t *testing.T) {
 	buf, msg := initMsg(t)
 
-	r := NewReceiver(":8000")
-	r.GoStart()
+	r := NewReceiver("127.0.0.1:0")
+	if err := r.GoStart(); err != nil {
+		t.Fatal(err)
+	}
 	defer r.Stop()
 
 	c := make(chan *Message)
@@ -34,7 +36,7 @@ func TestBlockRecv(t *testing.T) {
 	}
 
 	// start sending
-	go send("8000", buf, t)
+	send(r.Addr().String(), buf, t)
 	outMsg := <-c
 	compareMsg(msg, outMsg, t)
 }
@@ -43,12 +45,12 @@ func TestNonBlockRecv(t *testing.T) {
 	buf, msg := initMsg(t)
 
 	// start receiver
-	r := NewReceiver(":8001")
-	r.GoStart()
+	r := NewReceiver("127.0.0.1:0")
+	if err := r.GoStart(); err != nil {
+		t.Fatal(err)
+	}
 	defer r.Stop()
 
-	time.Sleep(50 * time.Millisecond) // wait for server to start
-
 	// should not receive anything
 	outMsg := r.GoRecv()
 	if outMsg != nil {
@@ -56,7 +58,7 @@ func TestNonBlockRecv(t *testing.T) {
 	}
 
 	// start sending
-	go send("8001", buf, t)
+	send(r.Addr().String(), buf, t)
 	time.Sleep(50 * time.Millisecond) // wait for socket to be available
 
 	outMsg = r.GoRecv()
@@ -69,8 +71,10 @@ func TestNonBlockRecv(t *testing.T) {
 func TestPbBlockRecv(t *testing.T) {
 	register(0, reflect.TypeOf(example.PreAccept{}))
 	sp := NewPreAcceptSample()
-	r := NewPbReceiver(":8000")
-	r.GoStart()
+	r := NewPbReceiver("127.0.0.1:0")
+	if err := r.GoStart(); err != nil {
+		t.Fatal(err)
+	}
 	defer r.Stop()
 
 	c := make(chan *PbMessage)
@@ -86,7 +90,7 @@ func TestPbBlockRecv(t *testing.T) {
 	}
 
 	// start sending
-	sender, err := NewPbSender(":8000")
+	sender, err := NewPbSender(r.Addr().String())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -99,12 +103,12 @@ func TestPbBlockRecv(t *testing.T) {
 func TestPbNonBlockRecv(t *testing.T) {
 	register(0, reflect.TypeOf(example.PreAccept{}))
 	sp := NewPreAcceptSample()
-	r := NewPbReceiver(":8001")
-	r.GoStart()
+	r := NewPbReceiver("127.0.0.1:0")
+	if err := r.GoStart(); err != nil {
+		t.Fatal(err)
+	}
 	defer r.Stop()
 
-	time.Sleep(50 * time.Millisecond) // wait for server to start
-
 	// should not receive anything
 	outMsg := r.GoRecv()
 	if outMsg != nil {
@@ -112,7 +116,7 @@ func TestPbNonBlockRecv(t *testing.T) {
 	}
 
 	// start sending
-	sender, err := NewPbSender(":8001")
+	sender, err := NewPbSender(r.Addr().String())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -128,12 +132,13 @@ func TestPbNonBlockRecv(t *testing.T) {
 }
 
 func TestSendTrash(t *testing.T) {
-	r := NewReceiver(":8002")
-	r.GoStart()
+	r := NewReceiver("127.0.0.1:0")
+	if err := r.GoStart(); err != nil {
+		t.Fatal(err)
+	}
 	defer r.Stop()
-	time.Sleep(50 * time.Millisecond)
 
-	conn, err := net.Dial("tcp", ":8002")
+	conn, err := net.Dial("tcp", r.Addr().String())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -151,12 +156,13 @@ func TestSendTrash(t *testing.T) {
 
 func TestSendPbNil(t *testing.T) {
 	register(0, reflect.TypeOf(example.PreAccept{}))
-	r := NewPbReceiver(":8002")
-	r.GoStart()
+	r := NewPbReceiver("127.0.0.1:0")
+	if err := r.GoStart(); err != nil {
+		t.Fatal(err)
+	}
 	defer r.Stop()
-	time.Sleep(50 * time.Millisecond)
 
-	sender, err := NewPbSender(":8002")
+	sender, err := NewPbSender(r.Addr().String())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -170,54 +176,62 @@ func TestSendPbNil(t *testing.T) {
 
 // Test whether receiver can stop and listen again
 func TestStopRestart(t *testing.T) {
-	r := NewReceiver(":8003")
-	r.GoStart()
+	r := NewReceiver("127.0.0.1:0")
+	if err := r.GoStart(); err != nil {
+		t.Fatal(err)
+	}
 	defer r.Stop()
-	time.Sleep(50 * time.Millisecond)
 
 	r.Stop()
-	r.GoStart()
-	time.Sleep(50 * time.Millisecond) // prevent running r.Stop() before r.GoStart()
+	if err := r.GoStart(); err != nil {
+		t.Fatal(err)
+	}
 }
 
 // Test multiple stop
 func TestMultipleStop(t *testing.T) {
-	r := NewReceiver(":8004")
-	r.GoStart()
+	r := NewReceiver("127.0.0.1:0")
+	if err := r.GoStart(); err != nil {
+		t.Fatal(err)
+	}
 	defer r.Stop()
-	time.Sleep(50 * time.Millisecond)
 
 	for i := 0; i < 5; i++ {
 		r.Stop()
 	}
-	r.GoStart()
-	time.Sleep(50 * time.Millisecond) // prevent running r.Stop() before r.GoStart()
+	if err := r.GoStart(); err != nil {
+		t.Fatal(err)
+	}
 }
 
 // Test whether receiver can stop and listen again for PbReceiver
 func TestPbStopRestart(t *testing.T) {
-	r := NewPbReceiver(":8003")
-	r.GoStart()
+	r := NewPbReceiver("127.0.0.1:0")
+	if err := r.GoStart(); err != nil {
+		t.Fatal(err)
+	}
 	defer r.Stop()
-	time.Sleep(50 * time.Millisecond)
 
 	r.Stop()
-	r.GoStart()
-	time.Sleep(50 * time.Millisecond) // prevent running r.Stop() before r.GoStart()
+	if err := r.GoStart(); err != nil {
+		t.Fatal(err)
+	}
 }
 
 // Test multiple stop for PbReceiver
 func TestPbMultipleStop(t *testing.T) {
-	r := NewPbReceiver(":8004")
-	r.GoStart()
+	r := NewPbReceiver("127.0.0.1:0")
+	if err := r.GoStart(); err != nil {
+		t.Fatal(err)
+	}
 	defer r.Stop()
-	time.Sleep(50 * time.Millisecond)
 
 	for i := 0; i < 5; i++ {
 		r.Stop()
 	}
-	r.GoStart()
-	time.Sleep(50 * time.Millisecond) // prevent running r.Stop() before r.GoStart()
+	if err := r.GoStart(); err != nil {
+		t.Fatal(err)
+	}
 }
 
 // Test multiple message
@@ -227,13 +241,14 @@ func TestMultipleMessage(t *testing.T) {
 	secBuf, _ := initMsg(t)
 	secBuf.WriteTo(buf) // write second message
 
-	r := NewReceiver(":8005")
-	r.GoStart()
+	r := NewReceiver("127.0.0.1:0")
+	if err := r.GoStart(); err != nil {
+		t.Fatal(err)
+	}
 	defer r.Stop()
-	time.Sleep(50 * time.Millisecond)
 
 	// start sending
-	go send("8005", buf, t)
+	send(r.Addr().String(), buf, t)
 
 	// test correctness
 	go func() {
@@ -261,13 +276,14 @@ func TestMultiplePbMessage(t *testing.T) {
 	finish := make(chan bool)
 
 	// start receiver
-	r := NewPbReceiver(":8005")
-	r.GoStart()
+	r := NewPbReceiver("127.0.0.1:0")
+	if err := r.GoStart(); err != nil {
+		t.Fatal(err)
+	}
 	defer r.Stop()
-	time.Sleep(50 * time.Millisecond)
 
 	// start sending
-	sender, err := NewPbSender(":8005")
+	sender, err := NewPbSender(r.Addr().String())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -297,18 +313,17 @@ func TestMultiplePbMessage(t *testing.T) {
 
 // Test send out a message and wait for reply
 func TestSendAndReply(t *testing.T) {
-	addr := ":8006"
-	go mockServer(addr)
-
-	// wait for server to start
-	time.Sleep(time.Millisecond * 50)
-	sendAndRecv(addr, t)
+	r := mockServer(t)
+	defer r.Stop()
+	sendAndRecv(r.Addr().String(), t)
 }
 
 // Test send out a message to a local receiver and wait for reply
 func TestSendTo(t *testing.T) {
-	r := NewReceiver(":8007")
-	r.GoStart()
+	r := NewReceiver("127.0.0.1:0")
+	if err := r.GoStart(); err != nil {
+		t.Fatal(err)
+	}
 	defer r.Stop()
 
 	go func() {
@@ -327,8 +342,10 @@ func TestSendTo(t *testing.T) {
 // Test send out a pbmessage to a local receiver and wait for reply
 func TestPbSendTo(t *testing.T) {
 	register(MsgRequireReply+1, reflect.TypeOf(example.PreAccept{}))
-	r := NewPbReceiver(":8007")
-	r.GoStart()
+	r := NewPbReceiver("127.0.0.1:0")
+	if err := r.GoStart(); err != nil {
+		t.Fatal(err)
+	}
 	defer r.Stop()
 
 	sp := NewPreAcceptSample()
@@ -366,8 +383,8 @@ func initMsg(t *testing.T) (*bytes.Buffer, *Message) {
 	return buf, msg
 }
 
-func send(port string, buf *bytes.Buffer, t *testing.T) {
-	conn, err := net.Dial("tcp", ":"+port)
+func send(addr string, buf *bytes.Buffer, t *testing.T) {
+	conn, err := net.Dial("tcp", addr)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -405,25 +422,51 @@ func sendAndRecv(addr string, t *testing.T) {
 }
 
 func compareMsg(msg, outMsg interface{}, t *testing.T) {
+	// the connection a message was received from is not part of it
+	if m, ok := outMsg.(*Message); ok && m != nil {
+		cp := *m
+		cp.conn = nil
+		outMsg = &cp
+	}
 	if !reflect.DeepEqual(msg, outMsg) {
 		t.Fatal("Messages are not equal!")
 	}
 
 }
 
-func mockServer(addr string) {
-	r := NewReceiver(addr)
-	r.GoStart()
+// mockServer starts a receiver which replies to one request
+func mockServer(t *testing.T) *Receiver {
+	r := NewReceiver("127.0.0.1:0")
+	if err := r.GoStart(); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		msg := r.Recv()
+		msg.reply <- NewMessage(0, append([]byte("a reply to "), msg.bytes...))
+	}()
+	return r
+}
 
-	msg := r.Recv()
-	msg.reply <- NewMessage(0, append([]byte("a reply to "), msg.bytes...))
+// echo replies to every request with its own bytes
+func echo(r *Receiver) {
+	for {
+		msg := r.Recv()
+		if msg.RequireReply() {
+			msg.reply <- NewMessage(0, msg.Bytes())
+		}
+	}
 }
 
-func mockPbServer(addr string) {
+// mockPbServer starts a receiver which replies to one request
+func mockPbServer(t *testing.T) *PbReceiver {
 	register(MsgRequireReply+1, reflect.TypeOf(example.A{}))
-	r := NewPbReceiver(addr)
-	r.GoStart()
-
-	msg := r.Recv()
-	msg.reply <- NewPbMessage(msg.Type(), msg.Proto())
+	r := NewPbReceiver("127.0.0.1:0")
+	if err := r.GoStart(); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		msg := r.Recv()
+		msg.reply <- NewPbMessage(msg.Type(), msg.Proto())
+	}()
+	return r
 }
@@ -1,15 +1,90 @@
 package message
 
 import (
+	"errors"
 	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-log/log"
 )
 
-var registry map[uint8]reflect.Type
+var registry map[uint16]reflect.Type
 
 func init() {
-	registry = make(map[uint8]reflect.Type, 256)
+	registry = make(map[uint16]reflect.Type, 256)
 }
 
-func register(msgType uint8, t reflect.Type) {
+func register(msgType uint16, t reflect.Type) {
 	registry[msgType] = t
 }
+
+var (
+	ErrMsgSize     = errors.New("message: payload exceeds the max size of its type")
+	ErrUnknownType = errors.New("message: no protobuf type registered for the message type")
+)
+
+// Descriptor describes a message type. Types without a descriptor
+// follow the MsgRequireReply rule and have no limits.
+type Descriptor struct {
+	Name         string // used in logs
+	RequireReply bool
+	ReplyType    uint16        // type handlers are expected to reply with
+	Priority     int           // larger is more urgent
+	Idempotent   bool          // safe to send again after a broken connection
+	Timeout      time.Duration // default time to wait for the reply, 0 waits forever
+	MaxSize      int           // largest payload accepted, 0 for no limit
+}
+
+var (
+	descMu      sync.RWMutex
+	descriptors = make(map[uint16]*Descriptor)
+)
+
+// Register describes msgType, it should be called before any
+// message of the type is created
+func Register(msgType uint16, d Descriptor) {
+	descMu.Lock()
+	defer descMu.Unlock()
+	descriptors[msgType] = &d
+}
+
+// Lookup returns the descriptor of msgType, or nil if it is not registered
+func Lookup(msgType uint16) *Descriptor {
+	descMu.RLock()
+	defer descMu.RUnlock()
+	return descriptors[msgType]
+}
+
+// requireReply reports whether messages of msgType require reply
+func requireReply(msgType uint16) bool {
+	if d := Lookup(msgType); d != nil {
+		return d.RequireReply
+	}
+	return msgType > MsgRequireReply && msgType <= 0xff
+}
+
+// typeName returns the name of msgType for logging
+func typeName(msgType uint16) string {
+	if d := Lookup(msgType); d != nil && d.Name != "" {
+		return d.Name
+	}
+	return strconv.Itoa(int(msgType))
+}
+
+// checkSize checks a payload of size bytes against the max size of msgType
+func checkSize(msgType uint16, size int) error {
+	if d := Lookup(msgType); d != nil && d.MaxSize > 0 && size > d.MaxSize {
+		return ErrMsgSize
+	}
+	return nil
+}
+
+// checkReply logs a reply whose type is not the one registered for the request
+func checkReply(req, reply uint16) {
+	if d := Lookup(req); d != nil && d.ReplyType != 0 && d.ReplyType != reply {
+		log.Warning("reply of type ", typeName(reply), " to ", typeName(req),
+			", expect ", typeName(d.ReplyType))
+	}
+}
@@ -1,8 +1,10 @@
 package message
 
 import (
+	"bytes"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/go-epaxos/message/example"
 )
@@ -10,3 +12,109 @@ import (
 func TestRegister(t *testing.T) {
 	register(0, reflect.TypeOf(example.PreAccept{}))
 }
+
+func TestDescriptor(t *testing.T) {
+	Register(2000, Descriptor{Name: "Prepare", RequireReply: true})
+	Register(MsgRequireReply+100, Descriptor{Name: "Commit"})
+
+	if !NewMessage(2000, nil).RequireReply() {
+		t.Fatal("expect Prepare to require reply")
+	}
+	if NewMessage(MsgRequireReply+100, nil).RequireReply() {
+		t.Fatal("expect Commit not to require reply")
+	}
+	if typeName(2000) != "Prepare" || typeName(2001) != "2001" {
+		t.Fatal("unexpected type names")
+	}
+
+	// the flag travels with the message
+	buf := new(bytes.Buffer)
+	NewMsgEncoder(buf).Encode(NewMessage(MsgRequireReply+100, nil))
+	msg := NewEmptyMessage()
+	if err := NewMsgDecoder(buf).Decode(msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.RequireReply() {
+		t.Fatal("expect Commit not to require reply")
+	}
+}
+
+func TestDescriptorMaxSize(t *testing.T) {
+	Register(2002, Descriptor{Name: "Small", RequireReply: true, MaxSize: 4})
+
+	r := NewReceiver("127.0.0.1:0")
+	if err := r.GoStart(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+	go echo(r)
+
+	sender, err := NewSender(r.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sender.Send(NewMessage(2002, []byte("too large"))); err != ErrMsgSize {
+		t.Fatal("expect ErrMsgSize, got ", err)
+	}
+	// the connection is still usable
+	reply, err := sender.Send(NewMessage(2002, []byte("ok")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply.Bytes()) != "ok" {
+		t.Fatal("error recv!")
+	}
+}
+
+func TestDescriptorTimeout(t *testing.T) {
+	Register(2003, Descriptor{Name: "Slow", RequireReply: true, Timeout: 50 * time.Millisecond})
+
+	r := NewReceiver("127.0.0.1:0")
+	if err := r.GoStart(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	sender, err := NewSender(r.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// nobody replies
+	start := time.Now()
+	if _, err := sender.Send(NewMessage(2003, nil)); err == nil {
+		t.Fatal("expect a timeout")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatal("Send waited ", d)
+	}
+}
+
+func TestDescriptorIdempotent(t *testing.T) {
+	Register(2004, Descriptor{Name: "Read", RequireReply: true, Idempotent: true})
+
+	r := NewReceiver("127.0.0.1:0")
+	if err := r.GoStart(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+	go func() {
+		// break the connection of the first request
+		msg := r.Recv()
+		msg.Conn().conn.Close()
+		msg.reply <- nil
+		echo(r)
+	}()
+
+	p, err := NewPool(r.Addr().String(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	reply, err := p.Send(NewMessage(2004, []byte("hello")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply.Bytes()) != "hello" {
+		t.Fatal("error recv!")
+	}
+}
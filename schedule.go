@@ -0,0 +1,176 @@
+package message
+
+import (
+	"sync"
+	"time"
+
+	"github.com/coreos/go-log/log"
+)
+
+const (
+	wheelTick  = 5 * time.Millisecond // resolution of scheduled sends
+	wheelSlots = 256                  // one revolution is 1.28s
+)
+
+// Timer is a send scheduled by SendAfter or SendAt
+type Timer struct {
+	w       *timerWheel
+	fn      func()
+	at      time.Time // it does not fire before
+	rounds  int       // revolutions left before it fires
+	stopped bool
+	fired   bool
+}
+
+// Stop cancels the send, it returns false if the message
+// is already sent or the send was already canceled
+func (t *Timer) Stop() bool {
+	t.w.mu.Lock()
+	defer t.w.mu.Unlock()
+	if t.stopped || t.fired {
+		return false
+	}
+	t.stopped = true
+	return true
+}
+
+// timerWheel fires timers with wheelTick resolution. All timers share
+// one ticker, which runs only while timers are pending, so that a
+// replica can schedule thousands of retries cheaply.
+type timerWheel struct {
+	mu      sync.Mutex
+	slots   [wheelSlots][]*Timer
+	pos     int
+	pending int
+	running bool
+}
+
+var wheel = new(timerWheel)
+
+// schedule calls fn on the wheel's goroutine after d,
+// fn must not block
+func (w *timerWheel) schedule(d time.Duration, fn func()) *Timer {
+	ticks := int((d + wheelTick - 1) / wheelTick)
+	if ticks < 1 {
+		ticks = 1
+	}
+	t := &Timer{
+		w:      w,
+		fn:     fn,
+		at:     time.Now().Add(d),
+		rounds: (ticks - 1) / wheelSlots,
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	slot := (w.pos + ticks) % wheelSlots
+	w.slots[slot] = append(w.slots[slot], t)
+	w.pending++
+	if !w.running {
+		w.running = true
+		go w.run()
+	}
+	return t
+}
+
+func (w *timerWheel) run() {
+	ticker := time.NewTicker(wheelTick)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		w.mu.Lock()
+		w.pos = (w.pos + 1) % wheelSlots
+		slot := w.slots[w.pos]
+		now := time.Now()
+		var due, late []*Timer
+		keep := slot[:0]
+		for _, t := range slot {
+			switch {
+			case t.stopped:
+				w.pending--
+			case t.rounds > 0:
+				t.rounds--
+				keep = append(keep, t)
+			case now.Before(t.at):
+				// scheduled in the middle of a tick, wait for the next
+				late = append(late, t)
+			default:
+				t.fired = true
+				w.pending--
+				due = append(due, t)
+			}
+		}
+		for i := len(keep); i < len(slot); i++ {
+			slot[i] = nil
+		}
+		w.slots[w.pos] = keep
+		next := (w.pos + 1) % wheelSlots
+		w.slots[next] = append(w.slots[next], late...)
+		done := w.pending == 0
+		if done {
+			w.running = false
+		}
+		w.mu.Unlock()
+
+		for _, t := range due {
+			t.fn()
+		}
+		if done {
+			return
+		}
+	}
+}
+
+// SendAfter sends a message to a local receiver after d, e.g. a protocol
+// timeout the replica sends to itself. The reply, if any, is dropped.
+func SendAfter(r *Receiver, d time.Duration, m *Message) *Timer {
+	return wheel.schedule(d, func() { go SendTo(r, m) })
+}
+
+// SendAt sends a message to a local receiver at t, see SendAfter
+func SendAt(r *Receiver, t time.Time, m *Message) *Timer {
+	return SendAfter(r, time.Until(t), m)
+}
+
+// PbSendAfter sends a message to a local receiver after d, see SendAfter
+func PbSendAfter(r *PbReceiver, d time.Duration, m *PbMessage) *Timer {
+	return wheel.schedule(d, func() { go PbSendTo(r, m) })
+}
+
+// PbSendAt sends a message to a local receiver at t, see SendAfter
+func PbSendAt(r *PbReceiver, t time.Time, m *PbMessage) *Timer {
+	return PbSendAfter(r, time.Until(t), m)
+}
+
+// SendAfter sends a message after d. The reply, if any, is dropped
+// and a failed send is only logged.
+func (s *Sender) SendAfter(d time.Duration, msg *Message) *Timer {
+	return wheel.schedule(d, func() {
+		go func() {
+			if _, err := s.Send(msg); err != nil {
+				log.Warning("Sender.SendAfter() error: ", err)
+			}
+		}()
+	})
+}
+
+// SendAt sends a message at t, see SendAfter
+func (s *Sender) SendAt(t time.Time, msg *Message) *Timer {
+	return s.SendAfter(time.Until(t), msg)
+}
+
+// SendAfter sends a message after d, see Sender.SendAfter
+func (s *PbSender) SendAfter(d time.Duration, msg *PbMessage) *Timer {
+	return wheel.schedule(d, func() {
+		go func() {
+			if _, err := s.Send(msg); err != nil {
+				log.Warning("PbSender.SendAfter() error: ", err)
+			}
+		}()
+	})
+}
+
+// SendAt sends a message at t, see Sender.SendAfter
+func (s *PbSender) SendAt(t time.Time, msg *PbMessage) *Timer {
+	return s.SendAfter(time.Until(t), msg)
+}
@@ -0,0 +1,109 @@
+package message
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSendAfter(t *testing.T) {
+	r := NewReceiver("127.0.0.1:0")
+
+	start := time.Now()
+	SendAfter(r, 60*time.Millisecond, NewMessage(1, []byte{60}))
+	SendAfter(r, 20*time.Millisecond, NewMessage(1, []byte{20}))
+	SendAt(r, start.Add(40*time.Millisecond), NewMessage(1, []byte{40}))
+
+	for _, d := range []byte{20, 40, 60} {
+		msg := r.Recv()
+		if msg.Bytes()[0] != d {
+			t.Fatal("expect the message due after ", d, "ms, got ", msg.Bytes()[0])
+		}
+		if time.Since(start) < time.Duration(d)*time.Millisecond {
+			t.Fatal("message sent early")
+		}
+	}
+}
+
+func TestTimerStop(t *testing.T) {
+	r := NewReceiver("127.0.0.1:0")
+
+	timer := SendAfter(r, 20*time.Millisecond, NewMessage(1, nil))
+	if !timer.Stop() {
+		t.Fatal("expect the timer to stop")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if r.GoRecv() != nil {
+		t.Fatal("canceled message is sent")
+	}
+	if timer.Stop() {
+		t.Fatal("expect the timer to be stopped once")
+	}
+}
+
+// Test delays longer than a revolution of the wheel
+func TestSendAfterRounds(t *testing.T) {
+	r := NewReceiver("127.0.0.1:0")
+
+	d := wheelSlots*wheelTick + 50*time.Millisecond
+	start := time.Now()
+	SendAfter(r, d, NewMessage(1, nil))
+	r.Recv()
+	if elapsed := time.Since(start); elapsed < d {
+		t.Fatal("message sent after ", elapsed, ", expect ", d)
+	}
+}
+
+func TestSenderSendAfter(t *testing.T) {
+	r := NewReceiver("127.0.0.1:0")
+	if err := r.GoStart(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	sender, err := NewSender(r.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	oneway := make(chan *Message, 1)
+	go func() {
+		for {
+			msg := r.Recv()
+			if msg.RequireReply() {
+				msg.reply <- NewMessage(0, msg.Bytes())
+			} else {
+				oneway <- msg
+			}
+		}
+	}()
+
+	start := time.Now()
+	sender.SendAfter(20*time.Millisecond, NewMessage(1, []byte("retry")))
+	// the scheduled send does not disturb the requests in between
+	reply, err := sender.Send(NewMessage(MsgRequireReply+1, []byte("hello")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply.Bytes()) != "hello" {
+		t.Fatal("error recv!")
+	}
+	msg := <-oneway
+	if string(msg.Bytes()) != "retry" || time.Since(start) < 20*time.Millisecond {
+		t.Fatal("error recv!")
+	}
+}
+
+// Test timers do not fire early wherever the wheel is within its tick
+func TestTimerNotEarly(t *testing.T) {
+	const n = 50
+	fired := make(chan time.Duration, n)
+	for i := 0; i < n; i++ {
+		start := time.Now()
+		wheel.schedule(10*time.Millisecond, func() { fired <- time.Since(start) })
+		time.Sleep(wheelTick / 5)
+	}
+	for i := 0; i < n; i++ {
+		if d := <-fired; d < 10*time.Millisecond {
+			t.Fatal("timer fired early, after ", d)
+		}
+	}
+}
@@ -1,14 +1,19 @@
 package message
 
 import (
+	"context"
+	"math"
 	"net"
+	"time"
 )
 
 type Sender struct {
-	remoteAddr *net.TCPAddr
-	conn       *net.TCPConn
+	mu         prioLock // one plain request at a time, guards sess
+	remoteAddr net.Addr
+	conn       net.Conn
 	encoder    *MsgEncoder
 	decoder    *MsgDecoder
+	sess       *session // set by OnPush
 }
 
 func NewSender(raddrStr string) (*Sender, error) {
@@ -30,12 +35,43 @@ func NewSender(raddrStr string) (*Sender, error) {
 	}, nil
 }
 
+// Send sends a message and waits for its reply if it requires one,
+// no longer than the Timeout registered for its type
 func (s *Sender) Send(msg *Message) (*Message, error) {
+	d := Lookup(msg.msgType)
+	timeout := d != nil && d.Timeout > 0 && msg.RequireReply()
+
+	s.mu.Lock(msg.Priority())
+	if sess := s.sess; sess != nil {
+		// sessions carry concurrent requests
+		s.mu.Unlock()
+		if timeout {
+			ctx, cancel := context.WithTimeout(context.Background(), d.Timeout)
+			defer cancel()
+			return sess.sendContext(ctx, msg)
+		}
+		return sess.send(msg)
+	}
+	defer s.mu.Unlock()
+
+	if timeout && s.conn != nil {
+		// a late reply would be taken for the reply of the next
+		// request, so the connection is closed on timeout
+		s.conn.SetDeadline(time.Now().Add(d.Timeout))
+		defer func() {
+			if s.conn != nil {
+				s.conn.SetDeadline(time.Time{})
+			}
+		}()
+	}
+
 	err := s.encoder.Encode(msg)
 	// TODO: handle recoverable error...
+	if notWritten(err) {
+		return nil, err
+	}
 	if err != nil {
-		s.conn.Close()
-		s.conn = nil
+		s.closeConn()
 		return nil, err
 	}
 
@@ -46,11 +82,48 @@ func (s *Sender) Send(msg *Message) (*Message, error) {
 	reply := NewEmptyMessage()
 	err = s.decoder.Decode(reply)
 	if err != nil {
+		s.closeConn()
+		return nil, err
+	}
+	return replyOrErr(reply)
+}
+
+// SendContext is like Send, but gives up waiting for the reply once ctx
+// is done. The receiver is told to cancel the request and drops its
+// reply. The connection is switched to the session format if needed.
+func (s *Sender) SendContext(ctx context.Context, msg *Message) (*Message, error) {
+	sess, err := s.session()
+	if err != nil {
+		return nil, err
+	}
+	return sess.sendContext(ctx, msg)
+}
+
+// Close closes the connection. Requests waiting for reply in the
+// session format fail, while Close waits for a request in flight in
+// the plain format, which is bounded by the Timeout of its type.
+func (s *Sender) Close() error {
+	s.mu.Lock(math.MaxInt8)
+	defer s.mu.Unlock()
+	if s.sess != nil {
+		// the session closes the connection
+		s.sess.close(nil)
+		s.conn = nil
+		return nil
+	}
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+func (s *Sender) closeConn() {
+	if s.conn != nil {
 		s.conn.Close()
 		s.conn = nil
-		return nil, err
 	}
-	return reply, nil
 }
 
 func (s *Sender) GoSend() {
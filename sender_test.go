@@ -3,19 +3,15 @@ package message
 import (
 	"reflect"
 	"testing"
-	"time"
 
 	"github.com/go-epaxos/message/example"
 )
 
 func TestSend(t *testing.T) {
-	addr := ":9000"
-	go mockServer(addr)
+	r := mockServer(t)
+	defer r.Stop()
 
-	// wait for the server to be available
-	time.Sleep(50 * time.Millisecond)
-
-	sender, err := NewSender(addr)
+	sender, err := NewSender(r.Addr().String())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -32,15 +28,33 @@ func TestSend(t *testing.T) {
 	}
 }
 
+func TestSendExtendedType(t *testing.T) {
+	r := NewReceiver("127.0.0.1:0")
+	if err := r.GoStart(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+	go echo(r)
+
+	sender, err := NewSender(r.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := sender.Send(NewRequest(1000, []byte("hello")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply.Bytes()) != "hello" {
+		t.Fatal("error recv!")
+	}
+}
+
 func TestSendPb(t *testing.T) {
 	register(MsgRequireReply+1, reflect.TypeOf(example.A{}))
-	addr := ":9001"
-	go mockPbServer(addr)
-
-	// wait for the server to be available
-	time.Sleep(50 * time.Millisecond)
+	r := mockPbServer(t)
+	defer r.Stop()
 
-	sender, err := NewPbSender(addr)
+	sender, err := NewPbSender(r.Addr().String())
 	if err != nil {
 		t.Fatal(err)
 	}
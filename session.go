@@ -0,0 +1,301 @@
+package message
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/coreos/go-log/log"
+)
+
+var (
+	ErrSessionClosed = errors.New("message: session is closed")
+)
+
+// session multiplexes requests and replies in both directions over one
+// connection in the session format. Incoming messages are handed to
+// deliver, replies to incoming requests are written back when the
+// handler sends them on the message's reply channel. Every incoming
+// request carries a context, canceled when the sender cancels the
+// request or the session closes.
+type session struct {
+	conn net.Conn
+	d    *MsgDecoder
+
+	wmu prioLock // serializes frames written by concurrent senders
+	e   *MsgEncoder
+
+	mu      sync.Mutex
+	nextID  uint32
+	pending map[uint32]chan *Message
+	streams map[uint32]*Stream
+	chunks  map[uint32]*chunkReader       // incoming chunked messages
+	cancels map[uint32]context.CancelFunc // incoming requests in flight
+	err     error
+
+	// flow control, see SetWindow
+	window    uint32        // credits granted to the peer at once, 0 for none
+	owed      uint32        // credits of released messages not granted yet
+	open      bool          // the peer sent its initial grant
+	unlimited bool          // the initial grant was 0, the peer does not limit us
+	granted   uint64        // credits granted by the peer
+	sent      uint64        // messages sent which take a credit
+	grant     chan struct{} // closed and replaced whenever the peer grants credits
+
+	deliver func(*Message)
+	track   *lifecycle // counts incoming requests in flight, may be nil
+	onClose func(*session)
+	done    chan struct{}
+	ctx     context.Context // parent of the incoming requests' contexts
+	cancel  context.CancelFunc
+}
+
+func newSession(conn net.Conn, d *MsgDecoder, e *MsgEncoder, deliver func(*Message)) *session {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &session{
+		conn:    conn,
+		d:       d,
+		e:       e,
+		pending: make(map[uint32]chan *Message),
+		streams: make(map[uint32]*Stream),
+		chunks:  make(map[uint32]*chunkReader),
+		cancels: make(map[uint32]context.CancelFunc),
+		grant:   make(chan struct{}),
+		deliver: deliver,
+		done:    make(chan struct{}),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+// writeFrame writes a frame once the frames of higher priority
+// waiting to be written are written
+func (s *session) writeFrame(kind uint8, id uint32, m *Message) error {
+	return s.writeFrameAt(m.Priority(), kind, id, m)
+}
+
+// writeFrameAt is like writeFrame, for frames which are part of
+// another message, e.g. a reply is written at the request's priority
+func (s *session) writeFrameAt(prio int, kind uint8, id uint32, m *Message) error {
+	s.wmu.Lock(prio)
+	defer s.wmu.Unlock()
+	return s.e.encodeFrame(kind, id, m)
+}
+
+// send sends a message and waits for its reply if it requires one.
+// It is safe for concurrent use.
+func (s *session) send(msg *Message) (*Message, error) {
+	return s.sendContext(context.Background(), msg)
+}
+
+// sendContext is like send, but gives up waiting for the reply once ctx
+// is done and tells the receiver to cancel the request.
+func (s *session) sendContext(ctx context.Context, msg *Message) (*Message, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := msg.check(); err != nil {
+		return nil, err
+	}
+
+	if err := s.acquire(ctx); err != nil {
+		return nil, err
+	}
+
+	if !msg.RequireReply() {
+		if err := s.writeFrame(frameMsg, 0, msg); err != nil {
+			s.close(err)
+			return nil, err
+		}
+		return nil, nil
+	}
+
+	ch := make(chan *Message, 1)
+	s.mu.Lock()
+	if err := s.err; err != nil {
+		s.mu.Unlock()
+		return nil, err
+	}
+	s.nextID++
+	id := s.nextID
+	s.pending[id] = ch
+	s.mu.Unlock()
+
+	if err := s.writeFrame(frameRequest, id, msg); err != nil {
+		s.close(err)
+		return nil, err
+	}
+
+	select {
+	case reply := <-ch:
+		return replyOrErr(reply)
+	case <-s.done:
+		return nil, s.err
+	case <-ctx.Done():
+		s.mu.Lock()
+		delete(s.pending, id)
+		s.mu.Unlock()
+		if err := s.writeFrameAt(msg.Priority(), frameCancel, id, NewEmptyMessage()); err != nil {
+			s.close(err)
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// run reads frames until the connection breaks
+func (s *session) run() {
+	defer s.closeChunks()
+	defer s.closeStreams()
+
+	for {
+		msg := NewEmptyMessage()
+		kind, id, err := s.d.decodeFrame(msg)
+		if err != nil {
+			s.close(err)
+			return
+		}
+		if err := s.dispatch(kind, id, msg); err != nil {
+			log.Warning("session.run() error: ", err)
+			s.close(err)
+			return
+		}
+	}
+}
+
+// dispatch handles a received frame
+func (s *session) dispatch(kind uint8, id uint32, msg *Message) error {
+	switch kind {
+	case frameMsg:
+		s.deliver(msg)
+	case frameRequest:
+		s.attachContext(id, msg)
+		msg.AttachReplyChan()
+		s.track.begin()
+		s.deliver(msg)
+		go s.reply(id, msg)
+	case frameReply:
+		s.mu.Lock()
+		ch := s.pending[id]
+		delete(s.pending, id)
+		s.mu.Unlock()
+		if ch != nil {
+			ch <- msg
+		}
+	case frameStreamRequest:
+		s.attachContext(id, msg)
+		msg.stream = make(chan *Message, streamBufSize)
+		s.track.begin()
+		s.deliver(msg)
+		go s.replyStream(id, msg)
+	case frameStreamReply:
+		s.mu.Lock()
+		st := s.streams[id]
+		s.mu.Unlock()
+		if st != nil {
+			st.ch <- msg
+		}
+	case frameStreamEnd:
+		s.mu.Lock()
+		st := s.streams[id]
+		delete(s.streams, id)
+		s.mu.Unlock()
+		if st != nil {
+			st.ended = true
+			close(st.ch)
+		}
+	case frameChunkStart, frameChunk, frameChunkEnd, frameChunkAbort:
+		s.dispatchChunk(kind, id, msg)
+	case frameCancel:
+		s.mu.Lock()
+		cancel := s.cancels[id]
+		delete(s.cancels, id)
+		s.mu.Unlock()
+		if cancel != nil {
+			cancel()
+		}
+	case frameCredit:
+		s.credit(id)
+	default:
+		return ErrBadFrame
+	}
+	return nil
+}
+
+// attachContext gives an incoming request a context
+// which a frameCancel of the same id cancels
+func (s *session) attachContext(id uint32, msg *Message) {
+	ctx, cancel := context.WithCancel(s.ctx)
+	msg.ctx = ctx
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cancels == nil {
+		// the session is closed
+		cancel()
+		return
+	}
+	s.cancels[id] = cancel
+}
+
+// forget forgets an incoming request once it is replied or canceled
+func (s *session) forget(id uint32) {
+	s.mu.Lock()
+	cancel := s.cancels[id]
+	delete(s.cancels, id)
+	s.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// reply waits for the handler's reply and sends it back,
+// a nil reply is sent as an empty message. Nothing is sent
+// for a canceled request.
+func (s *session) reply(id uint32, msg *Message) {
+	defer s.track.end()
+	defer s.forget(id)
+
+	select {
+	case replyMsg := <-msg.reply:
+		if replyMsg == nil {
+			replyMsg = NewEmptyMessage()
+		}
+		checkReply(msg.msgType, replyMsg.msgType)
+		if err := s.writeFrameAt(msg.Priority(), frameReply, id, replyMsg); err != nil {
+			log.Warning("session.reply() error: ", err, " replying to ", typeName(msg.msgType))
+			s.close(err)
+		}
+	case <-msg.ctx.Done():
+	}
+}
+
+// Close closes the session, so that a receiver which stops wakes the
+// goroutines waiting on it, which closing the connection alone does not
+func (s *session) Close() error {
+	s.close(nil)
+	return nil
+}
+
+// close closes the connection and fails all requests waiting for reply
+func (s *session) close(err error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return
+	}
+	if err == nil {
+		err = ErrSessionClosed
+	}
+	s.err = err
+	s.pending = nil
+	s.cancels = nil
+	s.mu.Unlock()
+
+	close(s.done)
+	s.cancel()
+	s.conn.Close()
+	if s.onClose != nil {
+		s.onClose(s)
+	}
+}
@@ -0,0 +1,370 @@
+//go:build linux
+// +build linux
+
+package message
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// A shared memory file holds two single-producer/single-consumer
+// byte rings, one per direction, so that two processes on the same
+// host can exchange the same frames as over TCP.
+//
+// file layout:
+//
+//	[0, shmFileHeader)            magic, ring size
+//	[shmFileHeader, +ring)        ring 0: dialer -> listener
+//	[..., +ring)                  ring 1: listener -> dialer
+//
+// ring layout, every counter on its own cache line:
+//
+//	head      uint64  next byte to read, written by the consumer
+//	tail      uint64  next byte to write, written by the producer
+//	dataSeq   uint32  futex, bumped when data is written
+//	dataWait  uint32  consumer is (about to be) waiting on dataSeq
+//	spaceSeq  uint32  futex, bumped when data is read
+//	spaceWait uint32  producer is (about to be) waiting on spaceSeq
+//	closed    uint32
+//	data      [size]byte
+const (
+	DefaultShmRingSize = 1 << 20
+
+	shmMagic      = 0x65707873 // "epxs"
+	shmFileHeader = 64
+
+	ringHead      = 0
+	ringTail      = 64
+	ringDataSeq   = 128
+	ringDataWait  = 132
+	ringSpaceSeq  = 192
+	ringSpaceWait = 196
+	ringClosed    = 256
+	ringHeader    = 320
+
+	futexWait = 0
+	futexWake = 1
+
+	shmSpin        = 64                     // yields before sleeping on futex
+	shmWaitTimeout = 100 * time.Millisecond // recheck closed flag
+)
+
+var (
+	ErrBadShmFile = errors.New("message: not a shared memory ring file")
+
+	errShmDeadline = errors.New("message: shared memory conn does not support deadlines")
+)
+
+type shmRing struct {
+	mem  []byte
+	data []byte
+	mask uint64
+}
+
+func newShmRing(mem []byte, size int) *shmRing {
+	return &shmRing{
+		mem:  mem,
+		data: mem[ringHeader : ringHeader+size],
+		mask: uint64(size - 1),
+	}
+}
+
+func (r *shmRing) u64(off int) *uint64 { return (*uint64)(unsafe.Pointer(&r.mem[off])) }
+
+func (r *shmRing) u32(off int) *uint32 { return (*uint32)(unsafe.Pointer(&r.mem[off])) }
+
+func (r *shmRing) isClosed() bool { return atomic.LoadUint32(r.u32(ringClosed)) != 0 }
+
+func (r *shmRing) close() {
+	atomic.StoreUint32(r.u32(ringClosed), 1)
+	atomic.AddUint32(r.u32(ringDataSeq), 1)
+	atomic.AddUint32(r.u32(ringSpaceSeq), 1)
+	futex(r.u32(ringDataSeq), futexWake, 1<<30)
+	futex(r.u32(ringSpaceSeq), futexWake, 1<<30)
+}
+
+// wait blocks until ready() returns true or the ring is closed.
+// seq is the futex bumped by the other side, flag tells the other side
+// that a wake up is needed.
+func (r *shmRing) wait(seqOff, flagOff int, ready func() bool) bool {
+	for i := 0; i < shmSpin; i++ {
+		if ready() {
+			return true
+		}
+		runtime.Gosched()
+	}
+
+	seq, flag := r.u32(seqOff), r.u32(flagOff)
+	for {
+		v := atomic.LoadUint32(seq)
+		atomic.StoreUint32(flag, 1)
+		if ready() {
+			atomic.StoreUint32(flag, 0)
+			return true
+		}
+		if r.isClosed() {
+			atomic.StoreUint32(flag, 0)
+			return false
+		}
+		futex(seq, futexWait, v)
+		atomic.StoreUint32(flag, 0)
+	}
+}
+
+// signal bumps seq and wakes the other side if it is waiting
+func (r *shmRing) signal(seqOff, flagOff int) {
+	atomic.AddUint32(r.u32(seqOff), 1)
+	if atomic.LoadUint32(r.u32(flagOff)) != 0 {
+		futex(r.u32(seqOff), futexWake, 1)
+	}
+}
+
+func (r *shmRing) read(p []byte) (int, error) {
+	head, tail := r.u64(ringHead), r.u64(ringTail)
+	h := atomic.LoadUint64(head)
+	ok := r.wait(ringDataSeq, ringDataWait, func() bool {
+		return atomic.LoadUint64(tail) != h
+	})
+	t := atomic.LoadUint64(tail)
+	if !ok && t == h {
+		return 0, io.EOF
+	}
+
+	n := int(t - h)
+	if n > len(p) {
+		n = len(p)
+	}
+	off := int(h & r.mask)
+	c := copy(p[:n], r.data[off:])
+	copy(p[c:n], r.data)
+
+	atomic.StoreUint64(head, h+uint64(n))
+	r.signal(ringSpaceSeq, ringSpaceWait)
+	return n, nil
+}
+
+func (r *shmRing) write(p []byte) (int, error) {
+	head, tail := r.u64(ringHead), r.u64(ringTail)
+	size := r.mask + 1
+	written := 0
+	for len(p) > 0 {
+		t := atomic.LoadUint64(tail)
+		ok := r.wait(ringSpaceSeq, ringSpaceWait, func() bool {
+			return t-atomic.LoadUint64(head) < size
+		})
+		if !ok || r.isClosed() {
+			return written, io.ErrClosedPipe
+		}
+
+		n := int(size - (t - atomic.LoadUint64(head)))
+		if n > len(p) {
+			n = len(p)
+		}
+		off := int(t & r.mask)
+		c := copy(r.data[off:], p[:n])
+		copy(r.data, p[c:n])
+
+		atomic.StoreUint64(tail, t+uint64(n))
+		r.signal(ringDataSeq, ringDataWait)
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func futex(addr *uint32, op int, val uint32) {
+	var ts *syscall.Timespec
+	if op == futexWait {
+		t := syscall.NsecToTimespec(int64(shmWaitTimeout))
+		ts = &t
+	}
+	// EAGAIN, EINTR and ETIMEDOUT all mean: check again
+	syscall.Syscall6(syscall.SYS_FUTEX, uintptr(unsafe.Pointer(addr)), uintptr(op),
+		uintptr(val), uintptr(unsafe.Pointer(ts)), 0, 0)
+}
+
+type shmAddr string
+
+func (a shmAddr) Network() string { return "shm" }
+
+func (a shmAddr) String() string { return string(a) }
+
+// ShmConn is a net.Conn over a shared memory file.
+// It does not support deadlines.
+type ShmConn struct {
+	path string
+	mem  []byte
+	rx   *shmRing
+	tx   *shmRing
+
+	// held for reading while a Read/Write is in progress,
+	// so that Close does not unmap memory still being used
+	mu       sync.RWMutex
+	unmapped bool
+}
+
+// ListenShm creates (or truncates) the shared memory file at path,
+// e.g. /dev/shm/epaxos-0, and returns the listening end of the connection.
+// size is the capacity of each ring and is rounded up to a power of two.
+func ListenShm(path string, size int) (*ShmConn, error) {
+	ringSize := 64 // keeps the second ring aligned
+	for ringSize < size {
+		ringSize <<= 1
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if err := f.Truncate(int64(shmFileHeader + 2*(ringHeader+ringSize))); err != nil {
+		return nil, err
+	}
+	c, err := mapShm(f, path, false)
+	if err != nil {
+		return nil, err
+	}
+	binary.LittleEndian.PutUint32(c.mem[4:], uint32(ringSize))
+	atomic.StoreUint32((*uint32)(unsafe.Pointer(&c.mem[0])), shmMagic)
+	return c, nil
+}
+
+// DialShm opens the shared memory file created by ListenShm
+func DialShm(path string) (*ShmConn, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return mapShm(f, path, true)
+}
+
+func mapShm(f *os.File, path string, dial bool) (*ShmConn, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() < shmFileHeader {
+		return nil, ErrBadShmFile
+	}
+
+	mem, err := syscall.Mmap(int(f.Fd()), 0, int(fi.Size()),
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+
+	ringSize := int(fi.Size()-shmFileHeader)/2 - ringHeader
+	if dial {
+		magic := atomic.LoadUint32((*uint32)(unsafe.Pointer(&mem[0])))
+		if magic != shmMagic || int(binary.LittleEndian.Uint32(mem[4:])) != ringSize {
+			syscall.Munmap(mem)
+			return nil, ErrBadShmFile
+		}
+	}
+
+	ring0 := newShmRing(mem[shmFileHeader:], ringSize)
+	ring1 := newShmRing(mem[shmFileHeader+ringHeader+ringSize:], ringSize)
+	c := &ShmConn{path: path, mem: mem}
+	if dial {
+		c.rx, c.tx = ring1, ring0
+	} else {
+		c.rx, c.tx = ring0, ring1
+	}
+	return c, nil
+}
+
+func (c *ShmConn) Read(p []byte) (int, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.unmapped {
+		return 0, io.EOF
+	}
+	return c.rx.read(p)
+}
+
+func (c *ShmConn) Write(p []byte) (int, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.unmapped {
+		return 0, io.ErrClosedPipe
+	}
+	return c.tx.write(p)
+}
+
+// Close closes both directions, the peer sees io.EOF once it has read
+// everything already written.
+func (c *ShmConn) Close() error {
+	c.mu.RLock()
+	if c.unmapped {
+		c.mu.RUnlock()
+		return nil
+	}
+	// wakes up our own blocked Read/Write too
+	c.rx.close()
+	c.tx.close()
+	c.mu.RUnlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.unmapped {
+		return nil
+	}
+	c.unmapped = true
+	return syscall.Munmap(c.mem)
+}
+
+func (c *ShmConn) LocalAddr() net.Addr { return shmAddr(c.path) }
+
+func (c *ShmConn) RemoteAddr() net.Addr { return shmAddr(c.path) }
+
+func (c *ShmConn) SetDeadline(t time.Time) error { return errShmDeadline }
+
+func (c *ShmConn) SetReadDeadline(t time.Time) error { return errShmDeadline }
+
+func (c *ShmConn) SetWriteDeadline(t time.Time) error { return errShmDeadline }
+
+// NewShmSender connects to a receiver serving the shared memory file at path
+func NewShmSender(path string) (*Sender, error) {
+	conn, err := DialShm(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Sender{
+		remoteAddr: conn.RemoteAddr(),
+		conn:       conn,
+		encoder:    NewMsgEncoder(conn),
+		decoder:    NewMsgDecoder(conn),
+	}, nil
+}
+
+// ServeShm creates the shared memory file at path and serves
+// the single process that dials it, like a TCP connection.
+// The connection is closed and unmapped when the receiver stops.
+func (r *Receiver) ServeShm(path string, size int) error {
+	conn, err := ListenShm(path, size)
+	if err != nil {
+		return err
+	}
+	if !r.lc.track(conn) {
+		return ErrReceiverClosed
+	}
+	go func() {
+		defer r.lc.untrack(conn)
+		r.handleConn(conn)
+	}()
+	return nil
+}
@@ -0,0 +1,166 @@
+//go:build linux
+// +build linux
+
+package message
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func shmTestPath(name string) string {
+	dir := "/dev/shm"
+	if _, err := os.Stat(dir); err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "message-"+name+"-"+strconv.Itoa(os.Getpid()))
+}
+
+// Test sending messages and replies through a shared memory ring
+func TestShmSend(t *testing.T) {
+	path := shmTestPath("test")
+	defer os.Remove(path)
+
+	r := NewReceiver(":0")
+	// small rings to exercise wrap around
+	if err := r.ServeShm(path, 64); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			msg := r.Recv()
+			if msg.RequireReply() {
+				msg.reply <- NewMessage(0, append([]byte("a reply to "), msg.bytes...))
+			}
+		}
+	}()
+
+	sender, err := NewShmSender(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.conn.Close()
+
+	for i := 0; i < 100; i++ {
+		if _, err := sender.Send(NewMessage(0, []byte("a one way message"))); err != nil {
+			t.Fatal(err)
+		}
+		reply, err := sender.Send(NewMessage(MsgRequireReply+1, []byte("a send")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(reply.Bytes()) != "a reply to a send" {
+			t.Fatal("error recv!")
+		}
+	}
+}
+
+func TestShmClose(t *testing.T) {
+	path := shmTestPath("close")
+	defer os.Remove(path)
+
+	ln, err := ListenShm(path, DefaultShmRingSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := DialShm(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := ln.Read(make([]byte, 1))
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	conn.Close()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("Read should fail after the peer closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Read is not woken up by Close")
+	}
+	ln.Close()
+}
+
+// Test Stop closes the shared memory connection
+func TestShmStop(t *testing.T) {
+	path := shmTestPath("stop")
+	defer os.Remove(path)
+
+	r := NewReceiver(":0")
+	if err := r.ServeShm(path, DefaultShmRingSize); err != nil {
+		t.Fatal(err)
+	}
+	go echo(r)
+
+	sender, err := NewShmSender(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.conn.Close()
+	if _, err := sender.Send(NewRequest(1, nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sender.Send(NewRequest(1, nil)); err == nil {
+		t.Fatal("expect the connection to be closed")
+	}
+	if err := r.ServeShm(path, DefaultShmRingSize); err != ErrReceiverClosed {
+		t.Fatal("expect a stopped receiver to refuse serving, got ", err)
+	}
+}
+
+// Compare small message round trips over a shared memory ring and loopback TCP
+func BenchmarkShmRoundTrip(b *testing.B) {
+	path := shmTestPath("bench")
+	defer os.Remove(path)
+
+	r := NewReceiver(":0")
+	if err := r.ServeShm(path, DefaultShmRingSize); err != nil {
+		b.Fatal(err)
+	}
+	go echo(r)
+
+	s, err := NewShmSender(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer s.conn.Close()
+	benchRoundTrip(b, s)
+}
+
+func BenchmarkTCPRoundTrip(b *testing.B) {
+	r := NewReceiver("127.0.0.1:0")
+	if err := r.GoStart(); err != nil {
+		b.Fatal(err)
+	}
+	defer r.Stop()
+	go echo(r)
+
+	s, err := NewSender(r.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchRoundTrip(b, s)
+}
+
+func benchRoundTrip(b *testing.B, s *Sender) {
+	msg := NewMessage(MsgRequireReply+1, []byte("hello"))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := s.Send(msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
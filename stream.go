@@ -0,0 +1,166 @@
+package message
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/coreos/go-log/log"
+)
+
+const (
+	streamBufSize = 64 // replies buffered per stream on both sides
+)
+
+var (
+	ErrNotStream = errors.New("message: request does not expect a stream of replies")
+)
+
+// Stream is the sequence of replies to a request sent by SendStream,
+// e.g. the instances a lagging replica has to catch up with.
+// The connection is not read while the buffer of a stream is full,
+// so replies should be consumed promptly.
+type Stream struct {
+	ch    chan *Message
+	s     *session
+	ended bool
+}
+
+// Next returns the next reply, or io.EOF after the last one
+func (st *Stream) Next() (*Message, error) {
+	m, ok := <-st.ch
+	if ok {
+		return replyOrErr(m)
+	}
+	if st.ended {
+		return nil, io.EOF
+	}
+	if st.s.err == io.EOF {
+		// the connection, not the stream, has ended
+		return nil, io.ErrUnexpectedEOF
+	}
+	return nil, st.s.err
+}
+
+// IsStream reports whether the sender expects a stream of replies,
+// which the handler sends by StreamReply and ends by EndStream
+func (m *Message) IsStream() bool { return m.stream != nil }
+
+// StreamReply sends one reply of a stream, it fails once the
+// request is canceled, or if the sender expects no stream
+func (m *Message) StreamReply(reply *Message) error {
+	if m.stream == nil {
+		return ErrNotStream
+	}
+	ctx := m.Context()
+	select {
+	case m.stream <- reply:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// EndStream sends the end-of-stream marker after the last reply,
+// it fails if the sender expects no stream
+func (m *Message) EndStream() error {
+	if m.stream == nil {
+		return ErrNotStream
+	}
+	close(m.stream)
+	return nil
+}
+
+func (s *session) sendStream(msg *Message) (*Stream, error) {
+	if err := msg.check(); err != nil {
+		return nil, err
+	}
+	if err := s.acquire(context.Background()); err != nil {
+		return nil, err
+	}
+	st := &Stream{
+		ch: make(chan *Message, streamBufSize),
+		s:  s,
+	}
+
+	s.mu.Lock()
+	if err := s.err; err != nil {
+		s.mu.Unlock()
+		return nil, err
+	}
+	s.nextID++
+	id := s.nextID
+	s.streams[id] = st
+	s.mu.Unlock()
+
+	if err := s.writeFrame(frameStreamRequest, id, msg); err != nil {
+		s.close(err)
+		return nil, err
+	}
+	return st, nil
+}
+
+// replyStream sends the handler's replies until it ends the stream
+func (s *session) replyStream(id uint32, msg *Message) {
+	defer s.track.end()
+	defer s.forget(id)
+
+	for {
+		select {
+		case replyMsg, ok := <-msg.stream:
+			kind := uint8(frameStreamReply)
+			if !ok {
+				kind, replyMsg = frameStreamEnd, NewEmptyMessage()
+			}
+			if err := s.writeFrameAt(msg.Priority(), kind, id, replyMsg); err != nil {
+				log.Warning("session.replyStream() error: ", err)
+				s.close(err)
+				return
+			}
+			if !ok {
+				return
+			}
+		case <-msg.ctx.Done():
+			return
+		}
+	}
+}
+
+// closeStreams fails the streams still open when the session breaks.
+// Only the goroutine running the session sends on the streams,
+// so only it may close them.
+func (s *session) closeStreams() {
+	s.mu.Lock()
+	streams := s.streams
+	s.streams = nil
+	s.mu.Unlock()
+
+	for _, st := range streams {
+		close(st.ch)
+	}
+}
+
+// SendStream sends a request whose handler replies with a stream of
+// messages, the connection is switched to the session format if needed.
+func (s *Sender) SendStream(msg *Message) (*Stream, error) {
+	sess, err := s.session()
+	if err != nil {
+		return nil, err
+	}
+	return sess.sendStream(msg)
+}
+
+// SendStream sends a request whose handler replies with a stream of messages
+func (c *PeerConn) SendStream(msg *Message) (*Stream, error) {
+	return c.sendStream(msg)
+}
+
+// SendStream sends a request to replica id, whose handler replies
+// with a stream of messages
+func (m *Mesh) SendStream(id NodeID, msg *Message) (*Stream, error) {
+	c, err := m.conn(id)
+	if err != nil {
+		return nil, err
+	}
+	return c.SendStream(msg)
+}
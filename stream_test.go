@@ -0,0 +1,109 @@
+package message
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestSendStream(t *testing.T) {
+	r := NewReceiver("127.0.0.1:0")
+	if err := r.GoStart(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	cnt := 200 // more than the stream buffer
+	go func() {
+		msg := r.Recv()
+		if !msg.IsStream() {
+			t.Error("expect a stream request")
+			return
+		}
+		for i := 0; i < cnt; i++ {
+			msg.StreamReply(NewMessage(0, []byte{byte(i)}))
+		}
+		msg.EndStream()
+	}()
+
+	sender, err := NewSender(r.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := sender.SendStream(NewMessage(MsgRequireReply+1, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; ; i++ {
+		reply, err := st.Next()
+		if err == io.EOF {
+			if i != cnt {
+				t.Fatal("expect ", cnt, " replies, got ", i)
+			}
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply.Bytes()[0] != byte(i) {
+			t.Fatal("replies out of order")
+		}
+	}
+
+	// normal requests still work on the same connection
+	go echo(r)
+	reply, err := sender.Send(NewMessage(MsgRequireReply+1, []byte("hello")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply.Bytes()) != "hello" {
+		t.Fatal("error recv!")
+	}
+}
+
+// Test a stream broken by the connection does not end with io.EOF
+func TestSendStreamBroken(t *testing.T) {
+	r := NewReceiver("127.0.0.1:0")
+	if err := r.GoStart(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	go func() {
+		msg := r.Recv()
+		msg.StreamReply(NewMessage(0, nil))
+		time.Sleep(10 * time.Millisecond)
+		msg.Conn().conn.Close()
+	}()
+
+	sender, err := NewSender(r.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := sender.SendStream(NewMessage(MsgRequireReply+1, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Next(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Next(); err == nil || err == io.EOF {
+		t.Fatal("expect a connection error, got ", err)
+	}
+}
+
+// Test a handler can not stream replies to a request which expects one
+func TestStreamReplyNotStream(t *testing.T) {
+	r := NewReceiver(":0")
+	go func() {
+		msg := r.Recv()
+		if err := msg.StreamReply(NewMessage(0, nil)); err != ErrNotStream {
+			t.Error("expect ErrNotStream, got ", err)
+		}
+		if err := msg.EndStream(); err != ErrNotStream {
+			t.Error("expect ErrNotStream, got ", err)
+		}
+		msg.reply <- NewMessage(0, nil)
+	}()
+	SendTo(r, NewRequest(1, nil))
+}
@@ -0,0 +1,156 @@
+package message
+
+import (
+	"bytes"
+	"errors"
+	"net"
+
+	"github.com/coreos/go-log/log"
+)
+
+const (
+	// MaxDatagramSize is the largest frame carried by one UDP datagram,
+	// an ethernet MTU of 1500 minus the IPv4 and UDP headers.
+	MaxDatagramSize = 1472
+)
+
+var (
+	ErrMsgTooLarge = errors.New("message: frame does not fit in a datagram")
+)
+
+// UDPSender sends messages that do not require reply as datagrams,
+// one frame per datagram. Messages that require reply are sent over
+// a stream connection which is dialed on first use.
+type UDPSender struct {
+	remoteAddr *net.UDPAddr
+	conn       *net.UDPConn
+	buf        *bytes.Buffer
+	encoder    *MsgEncoder
+	stream     *Sender
+}
+
+func NewUDPSender(raddrStr string) (*UDPSender, error) {
+	raddr, err := net.ResolveUDPAddr("udp", raddrStr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := new(bytes.Buffer)
+	return &UDPSender{
+		remoteAddr: raddr,
+		conn:       conn,
+		buf:        buf,
+		encoder:    NewMsgEncoder(buf),
+	}, nil
+}
+
+func (s *UDPSender) Send(msg *Message) (*Message, error) {
+	if msg.RequireReply() {
+		if s.stream == nil {
+			stream, err := NewSender(s.remoteAddr.String())
+			if err != nil {
+				return nil, err
+			}
+			s.stream = stream
+		}
+		reply, err := s.stream.Send(msg)
+		if err != nil {
+			// redial on next request
+			s.stream = nil
+		}
+		return reply, err
+	}
+
+	s.buf.Reset()
+	if err := s.encoder.Encode(msg); err != nil {
+		return nil, err
+	}
+	if s.buf.Len() > MaxDatagramSize {
+		return nil, ErrMsgTooLarge
+	}
+	_, err := s.conn.Write(s.buf.Bytes())
+	return nil, err
+}
+
+// GoStartUDP is like StartUDP, but reads the datagrams on a goroutine
+// of its own. The receiver listens once GoStartUDP returns without error.
+func (r *Receiver) GoStartUDP() error {
+	conn, err := r.listenUDP()
+	if err != nil {
+		return err
+	}
+	go r.serveUDP(conn)
+	return nil
+}
+
+// StartUDP listens for datagrams on the receiver's address and delivers
+// the messages they carry to the message channel until the receiver is
+// stopped. It returns the error of listening at once.
+func (r *Receiver) StartUDP() error {
+	conn, err := r.listenUDP()
+	if err != nil {
+		return err
+	}
+	r.serveUDP(conn)
+	return nil
+}
+
+// listenUDP listens on the receiver's address. A port of 0 is the port
+// of the stream listener if there is one, UDPSender expects both on the
+// same port.
+func (r *Receiver) listenUDP() (*net.UDPConn, error) {
+	addr := &net.UDPAddr{
+		IP:   r.localAddr.IP,
+		Port: r.localAddr.Port,
+		Zone: r.localAddr.Zone,
+	}
+	if tcp, ok := r.lc.Addr().(*net.TCPAddr); ok && addr.Port == 0 {
+		addr.Port = tcp.Port
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	r.lc.listen(conn)
+	return conn, nil
+}
+
+// serveUDP reads datagrams until the receiver is stopped
+func (r *Receiver) serveUDP(conn *net.UDPConn) {
+	defer r.lc.wg.Done()
+
+	// read one byte more than allowed to detect oversized datagrams
+	buf := make([]byte, MaxDatagramSize+1)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if !r.lc.listening(conn) {
+				return
+			}
+			log.Warning("ReadUDP() error: ", err)
+			continue
+		}
+		if n > MaxDatagramSize {
+			log.Warning("StartUDP() error: ", ErrMsgTooLarge)
+			continue
+		}
+
+		msg := NewEmptyMessage()
+		if err := decodeBytes(buf[:n], msg); err != nil {
+			log.Warning("StartUDP() error: ", err)
+			continue
+		}
+		if msg.RequireReply() {
+			// nobody to reply to
+			log.Warning("StartUDP() drops message of type ", typeName(msg.msgType), " that requires reply")
+			continue
+		}
+		// datagrams share a queue, but not their rate limits
+		r.deliverFrom(hostKey(addr), r.q.local, msg)
+	}
+}
@@ -0,0 +1,56 @@
+package message
+
+import (
+	"testing"
+)
+
+// Test one-way messages go over UDP while requests go over TCP
+func TestUDPSend(t *testing.T) {
+	r := NewReceiver("127.0.0.1:0")
+	if err := r.GoStart(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.GoStartUDP(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	sender, err := NewUDPSender(r.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inMsg := NewMessage(0, []byte("a datagram"))
+	if _, err := sender.Send(inMsg); err != nil {
+		t.Fatal(err)
+	}
+	outMsg := r.Recv()
+	compareMsg(inMsg, outMsg, t)
+
+	go func() {
+		msg := r.Recv()
+		msg.reply <- NewMessage(0, append([]byte("a reply to "), msg.bytes...))
+	}()
+	reply, err := sender.Send(NewMessage(MsgRequireReply+1, []byte("a send")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply.Bytes()) != "a reply to a send" {
+		t.Fatal("error recv!")
+	}
+	if sender.stream == nil {
+		t.Fatal("request should be sent over a stream")
+	}
+}
+
+func TestUDPSendTooLarge(t *testing.T) {
+	sender, err := NewUDPSender(":8011")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := NewMessage(0, make([]byte, MaxDatagramSize))
+	if _, err := sender.Send(msg); err != ErrMsgTooLarge {
+		t.Fatal("expect ErrMsgTooLarge, got ", err)
+	}
+}
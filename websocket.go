@@ -0,0 +1,151 @@
+package message
+
+import (
+	"bytes"
+	"net/http"
+
+	"github.com/coreos/go-log/log"
+	"github.com/gorilla/websocket"
+)
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+}
+
+// ServeHTTP upgrades the request to a WebSocket connection and serves it
+// like a TCP connection, every binary WebSocket message carries one frame.
+// So a PbReceiver can be mounted on any http.ServeMux.
+func (r *PbReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	ws, err := wsUpgrader.Upgrade(w, req, nil)
+	if err != nil {
+		// Upgrade() has already replied with an HTTP error
+		log.Warning("Upgrade() error: ", err)
+		return
+	}
+	if r.lc.track(ws) {
+		go func() {
+			defer r.lc.untrack(ws)
+			r.handleWS(ws)
+		}()
+	}
+}
+
+// handleWS decodes a message from every binary WebSocket message
+// and sends it to channel
+func (r *PbReceiver) handleWS(ws *websocket.Conn) {
+	buf := new(bytes.Buffer)
+	e := NewMsgEncoder(buf)
+	key := hostKey(ws.RemoteAddr())
+
+	for {
+		mt, data, err := ws.ReadMessage()
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				return
+			}
+			// TODO: handle error
+			log.Warning("handleWS() error: ", err)
+			return
+		}
+		if mt != websocket.BinaryMessage {
+			log.Warning("handleWS() drops non binary message")
+			continue
+		}
+
+		msg := NewEmptyPbMessage()
+		if err := NewMsgDecoder(bytes.NewReader(data)).DecodePb(msg); err != nil {
+			log.Warning("handleWS() error: ", err)
+			return
+		}
+
+		attached := msg.AttachReplyChan()
+		if attached {
+			r.lc.begin()
+		}
+
+		// send received message for processing
+		r.deliver(key, msg)
+
+		if attached {
+			// wait for reply
+			replyMsg := <-msg.reply
+			if replyMsg != nil {
+				buf.Reset()
+				err := e.EncodePb(replyMsg)
+				if err == nil {
+					err = ws.WriteMessage(websocket.BinaryMessage, buf.Bytes())
+				}
+				if err != nil {
+					r.lc.end()
+					log.Warning("handleWS() error: ", err)
+					return
+				}
+			}
+			r.lc.end()
+		}
+	}
+}
+
+// PbWSSender is a PbSender that talks to a PbReceiver over WebSocket,
+// for clients which can only reach it through an HTTP proxy.
+type PbWSSender struct {
+	url     string
+	ws      *websocket.Conn
+	buf     *bytes.Buffer
+	encoder *MsgEncoder
+}
+
+// NewPbWSSender dials a ws:// or wss:// url served by a PbReceiver
+func NewPbWSSender(url string) (*PbWSSender, error) {
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := new(bytes.Buffer)
+	return &PbWSSender{
+		url:     url,
+		ws:      ws,
+		buf:     buf,
+		encoder: NewMsgEncoder(buf),
+	}, nil
+}
+
+func (s *PbWSSender) Send(msg *PbMessage) (*PbMessage, error) {
+	s.buf.Reset()
+	if err := s.encoder.EncodePb(msg); err != nil {
+		return nil, err
+	}
+
+	err := s.ws.WriteMessage(websocket.BinaryMessage, s.buf.Bytes())
+	if err != nil {
+		s.ws.Close()
+		return nil, err
+	}
+
+	if !msg.RequireReply() {
+		return nil, nil
+	}
+
+	_, data, err := s.ws.ReadMessage()
+	if err != nil {
+		s.ws.Close()
+		return nil, err
+	}
+	reply := NewEmptyPbMessage()
+	if err := NewMsgDecoder(bytes.NewReader(data)).DecodePb(reply); err != nil {
+		return nil, err
+	}
+	if err := reply.Err(); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// Close sends a close message and closes the underlying connection
+func (s *PbWSSender) Close() error {
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	s.ws.WriteMessage(websocket.CloseMessage, msg)
+	return s.ws.Close()
+}
@@ -0,0 +1,108 @@
+package message
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-epaxos/message/example"
+	"github.com/gorilla/websocket"
+)
+
+// Test sending pbmessages to a PbReceiver mounted on an http server
+func TestPbWSSend(t *testing.T) {
+	register(0, reflect.TypeOf(example.PreAccept{}))
+	register(MsgRequireReply+1, reflect.TypeOf(example.PreAccept{}))
+	r := NewPbReceiver(":0")
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	sender, err := NewPbWSSender("ws" + strings.TrimPrefix(srv.URL, "http"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+
+	inMsg := NewPbMessage(0, NewPreAcceptSample())
+	if _, err := sender.Send(inMsg); err != nil {
+		t.Fatal(err)
+	}
+	compareMsg(inMsg, r.Recv(), t)
+
+	go func() {
+		msg := r.Recv()
+		msg.reply <- msg
+	}()
+	inMsg = NewPbMessage(MsgRequireReply+1, NewPreAcceptSample())
+	reply, err := sender.Send(inMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareMsg(inMsg, reply, t)
+}
+
+// Test a frame of an unregistered type drops the connection
+func TestPbWSUnknownType(t *testing.T) {
+	r := NewPbReceiver(":0")
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	frame := []byte{MsgRequireReply + 100, 1, 0, 0, 0, 0}
+	if err := ws.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ws.ReadMessage(); err == nil {
+		t.Fatal("expect the connection to be dropped")
+	}
+}
+
+// Test error replies are returned as errors
+func TestPbWSErrorReply(t *testing.T) {
+	register(MsgRequireReply+1, reflect.TypeOf(example.PreAccept{}))
+	r := NewPbReceiver(":0")
+	r.SetLimits(RateLimits{Peer: Limit{Rate: 1, Burst: 1, Action: LimitReject}})
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	go pbEcho(r)
+
+	sender, err := NewPbWSSender("ws" + strings.TrimPrefix(srv.URL, "http"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+
+	msg := NewPbMessage(MsgRequireReply+1, NewPreAcceptSample())
+	if _, err := sender.Send(msg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sender.Send(msg); err != ErrRateLimited {
+		t.Fatal("expect ErrRateLimited, got ", err)
+	}
+}
+
+// Test Stop closes the WebSocket connections
+func TestPbWSStop(t *testing.T) {
+	r := NewPbReceiver(":0")
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	if err := r.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ws.ReadMessage(); err == nil {
+		t.Fatal("expect the connection to be closed")
+	}
+}